@@ -5,65 +5,173 @@
 package roundtrippers
 
 import (
+	"bytes"
 	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/zstd"
 )
 
+// Decoder returns a reader that decompresses r.
+//
+// Closing the returned io.ReadCloser must release the resources held by the
+// decoder but must not close r.
+type Decoder func(r io.Reader) (io.ReadCloser, error)
+
+// DefaultDecoders is the registry of Content-Encoding tokens to decoders used
+// by AcceptCompressed when its Decoders field is unset.
+//
+// Add to it at init time to support more encodings process wide, e.g.
+// "deflate" or an in-house encoding.
+var DefaultDecoders = map[string]Decoder{
+	"br":   newBrotliDecoder,
+	"gzip": newGzipDecoder,
+	"zstd": newZstdDecoder,
+}
+
+// EncodingWeight is an encoding advertised in Accept-Encoding along with its
+// quality value.
+type EncodingWeight struct {
+	Name string
+	// Q is the quality value, between 0 and 1. Zero means the default of 1; omit
+	// the encoding to not advertise it.
+	Q float64
+}
+
+// DecompressionLimitError is returned while reading a response body decoded by
+// AcceptCompressed that exceeds MaxDecompressedBytes or MaxRatio.
+type DecompressionLimitError struct {
+	// Decompressed is the number of decoded bytes read so far.
+	Decompressed int64
+	// Compressed is the number of bytes read from the wire so far.
+	Compressed int64
+	// MaxBytes is AcceptCompressed.MaxDecompressedBytes.
+	MaxBytes int64
+	// MaxRatio is AcceptCompressed.MaxRatio.
+	MaxRatio float64
+}
+
+func (d *DecompressionLimitError) Error() string {
+	if d.MaxBytes > 0 && d.Decompressed > d.MaxBytes {
+		return fmt.Sprintf("decompressed body exceeds %d bytes", d.MaxBytes)
+	}
+	return fmt.Sprintf("decompressed body exceeds ratio %g: %d bytes from %d bytes", d.MaxRatio, d.Decompressed, d.Compressed)
+}
+
 // AcceptCompressed empowers the client to accept zstd, br and gzip compressed responses.
 type AcceptCompressed struct {
 	Transport http.RoundTripper
+	// Decoders maps a Content-Encoding token to its Decoder.
+	//
+	// If unset, defaults to DefaultDecoders.
+	Decoders map[string]Decoder
+	// Encodings lists the encodings advertised in Accept-Encoding in order of
+	// preference. Each of them must have a Decoder.
+	//
+	// If unset, every encoding in Decoders is advertised with the same weight.
+	Encodings []EncodingWeight
+	// KeepAcceptEncoding leaves the Accept-Encoding header untouched when the
+	// caller already set one. Set it to "identity" on a request to opt out of
+	// compression for this request.
+	KeepAcceptEncoding bool
+	// AllowUnknown returns the response untouched when the server replies with a
+	// Content-Encoding that was not advertised or that has no Decoder. Otherwise
+	// an error is returned.
+	AllowUnknown bool
+	// MaxDecompressedBytes caps the number of bytes that can be read from a
+	// decoded response body. Reading past it returns a *DecompressionLimitError.
+	//
+	// It is highly recommended when talking to untrusted servers to protect
+	// against decompression bombs. If unset, there is no limit.
+	MaxDecompressedBytes int64
+	// MaxRatio caps the ratio of decoded bytes over bytes read from the wire.
+	// Exceeding it returns a *DecompressionLimitError. It is only enforced once
+	// at least 64KiB were decoded so the first block doesn't trip it.
+	//
+	// If unset, there is no limit.
+	MaxRatio float64
+	// MaxLayers caps the number of stacked encodings accepted in a single
+	// Content-Encoding, e.g. "gzip, br" is 2 layers.
+	//
+	// If unset, defaults to 3.
+	MaxLayers int
+
+	// Dictionaries enables RFC 9842 Compression Dictionary Transport when set.
+	// Responses with a Use-As-Dictionary header are stored in it, and matching
+	// dictionaries are advertised with Available-Dictionary along "dcz".
+	//
+	// Only "dcz" (zstd) is supported; "dcb" (brotli) is not advertised since the
+	// brotli decoder doesn't support custom dictionaries.
+	Dictionaries DictionaryStore
+	// UncompressedLengthHeader is the name of a response header carrying the
+	// decoded size of the body, e.g. "X-Uncompressed-Content-Length". When
+	// present, it is used to set the response ContentLength.
+	//
+	// Independently, the ContentLength is set for single layer "zstd" responses
+	// whose frame header includes the content size. Otherwise it is -1.
+	UncompressedLengthHeader string
+	// Stats, when set, accumulates the compressed and decoded sizes of response
+	// bodies. A body is recorded when closed.
+	Stats *CompressionStats
+	// KeepCompressed negotiates the encoding but returns the response with its
+	// Content-Encoding and its body untouched. This is useful for caching
+	// proxies. Use Decompress to decode the response later.
+	//
+	// Dictionaries is ignored in this mode.
+	KeepCompressed bool
 
 	_ struct{}
 }
 
 // RoundTrip implements http.RoundTripper.
 func (a *AcceptCompressed) RoundTrip(req *http.Request) (*http.Response, error) {
+	decoders := a.Decoders
+	if decoders == nil {
+		decoders = DefaultDecoders
+	}
 	// The standard library includes gzip. Disable transparent compression and
-	// add br and zstd. Tell the server we prefer zstd.
+	// advertise what is registered instead.
 	req = req.Clone(req.Context())
-	req.Header.Set("Accept-Encoding", "zstd, br, gzip")
-	resp, err := a.Transport.RoundTrip(req)
-	if resp != nil {
-		// TODO: Handle "Content-Length" the same way stdlib does.
-		switch ce := resp.Header.Get("Content-Encoding"); ce {
-		case "br":
-			resp.Body = &body{r: brotli.NewReader(resp.Body), c: []io.Closer{resp.Body}}
-			resp.Header.Del("Content-Encoding")
-			resp.Header.Del("Content-Length")
-			resp.ContentLength = -1
-			resp.Uncompressed = true
-		case "gzip":
-			gz, err2 := gzip.NewReader(resp.Body)
-			if err2 != nil {
-				_ = resp.Body.Close()
-				return nil, errors.Join(err2, err)
-			}
-			resp.Body = &body{r: gz, c: []io.Closer{resp.Body, gz}}
-			resp.Header.Del("Content-Encoding")
-			resp.Header.Del("Content-Length")
-			resp.ContentLength = -1
-			resp.Uncompressed = true
-		case "zstd":
-			zs, err2 := zstd.NewReader(resp.Body)
-			if err2 != nil {
-				_ = resp.Body.Close()
-				return nil, errors.Join(err2, err)
+	ae := req.Header.Get("Accept-Encoding")
+	if !a.KeepAcceptEncoding || ae == "" {
+		var err error
+		if ae, err = a.acceptEncoding(decoders); err != nil {
+			return nil, err
+		}
+		if a.Dictionaries != nil && !a.KeepCompressed && req.Header.Get("Available-Dictionary") == "" {
+			if d := a.Dictionaries.Match(req); d != nil {
+				decoders = maps.Clone(decoders)
+				decoders["dcz"] = dczDecoder(d)
+				ae = strings.TrimSuffix("dcz, "+ae, ", ")
+				advertiseDictionary(req, d)
 			}
-			resp.Body = &body{r: zs, c: []io.Closer{resp.Body, &adapter{zs}}}
-			resp.Header.Del("Content-Encoding")
-			resp.Header.Del("Content-Length")
-			resp.ContentLength = -1
-			resp.Uncompressed = true
-		case "", "identity":
-		default:
+		}
+		req.Header.Set("Accept-Encoding", ae)
+	}
+	advertised := parseAcceptEncoding(ae)
+	resp, err := a.Transport.RoundTrip(req)
+	if resp != nil && !a.KeepCompressed {
+		if err2 := a.decode(resp, req.URL.Host, decoders, advertised); err2 != nil {
 			_ = resp.Body.Close()
-			return nil, fmt.Errorf("unsupported Content-Encoding %q", ce)
+			return nil, errors.Join(err2, err)
+		}
+		if a.Dictionaries != nil && resp.StatusCode == http.StatusOK {
+			if v := resp.Header.Get("Use-As-Dictionary"); v != "" {
+				// An invalid header is ignored, like a browser would do.
+				if d, err2 := parseUseAsDictionary(v, req.URL); err2 == nil {
+					resp.Body = &dictionaryBody{body: resp.Body, d: d, store: a.Dictionaries}
+				}
+			}
 		}
 	}
 	return resp, err
@@ -73,15 +181,309 @@ func (a *AcceptCompressed) Unwrap() http.RoundTripper {
 	return a.Transport
 }
 
+// Decompress decodes a response that was kept compressed, e.g. with
+// KeepCompressed. It uses the Decoders and the limits of a; the response body
+// is replaced and its Content-Encoding removed.
+//
+// Any registered encoding is accepted, regardless of what was advertised.
+func (a *AcceptCompressed) Decompress(resp *http.Response) error {
+	decoders := a.Decoders
+	if decoders == nil {
+		decoders = DefaultDecoders
+	}
+	host := ""
+	if resp.Request != nil && resp.Request.URL != nil {
+		host = resp.Request.URL.Host
+	}
+	return a.decode(resp, host, decoders, []EncodingWeight{{Name: "*", Q: 1}})
+}
+
+// decode replaces resp.Body with a reader that peels each Content-Encoding
+// layer in reverse order of application.
+func (a *AcceptCompressed) decode(resp *http.Response, host string, decoders map[string]Decoder, advertised []EncodingWeight) error {
+	codings := parseContentEncoding(resp.Header.Values("Content-Encoding"))
+	if len(codings) == 0 {
+		return nil
+	}
+	maxLayers := a.MaxLayers
+	if maxLayers == 0 {
+		maxLayers = 3
+	}
+	if len(codings) > maxLayers {
+		return fmt.Errorf("too many Content-Encoding layers: %d > %d", len(codings), maxLayers)
+	}
+	for _, c := range codings {
+		if decoders[c] != nil && accepts(advertised, c) {
+			continue
+		}
+		if a.AllowUnknown {
+			return nil
+		}
+		if decoders[c] == nil {
+			return fmt.Errorf("unsupported Content-Encoding %q", c)
+		}
+		return fmt.Errorf("unadvertised Content-Encoding %q", c)
+	}
+	// The caller closes resp.Body on error, only close the decoders here.
+	wire := &countingReader{r: resp.Body}
+	layers := &body{r: wire}
+	length := int64(-1)
+	if h := a.UncompressedLengthHeader; h != "" {
+		if v, err := strconv.ParseInt(resp.Header.Get(h), 10, 64); err == nil && v >= 0 {
+			length = v
+		}
+	}
+	if length == -1 && len(codings) == 1 && codings[0] == "zstd" {
+		// Peek at the frame header. Concatenated frames are valid, so only trust
+		// the frame content size when the body is provably a single frame: a
+		// single block whose end matches the compressed Content-Length.
+		hdr := make([]byte, zstd.HeaderMaxSize)
+		n, _ := io.ReadFull(wire, hdr)
+		var h zstd.Header
+		if h.Decode(hdr[:n]) == nil && h.HasFCS && h.FrameContentSize <= math.MaxInt64 && h.FirstBlock.OK && h.FirstBlock.Last {
+			size := int64(h.HeaderSize + 3 + h.FirstBlock.CompressedSize)
+			if h.HasCheckSum {
+				size += 4
+			}
+			if size == resp.ContentLength {
+				length = int64(h.FrameContentSize)
+			}
+		}
+		layers.r = io.MultiReader(bytes.NewReader(hdr[:n]), wire)
+	}
+	for i := len(codings) - 1; i >= 0; i-- {
+		r, err := decoders[codings[i]](layers.r)
+		if err != nil {
+			_ = layers.Close()
+			return err
+		}
+		layers.r = r
+		layers.c = append(layers.c, r)
+	}
+	if a.MaxDecompressedBytes > 0 || a.MaxRatio > 0 {
+		layers.r = &limitedReader{r: layers.r, wire: wire, maxBytes: a.MaxDecompressedBytes, maxRatio: a.MaxRatio}
+	}
+	if a.Stats != nil {
+		decoded := &countingReader{r: layers.r}
+		layers.r = decoded
+		key := CompressionStatsKey{Encoding: strings.Join(codings, ", "), Host: host}
+		layers.c = append(layers.c, &statsRecorder{stats: a.Stats, key: key, wire: wire, decoded: decoded})
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	if length >= 0 {
+		layers.r = &lengthReader{r: layers.r, remaining: length}
+		resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	resp.Body = &body{r: layers.r, c: append([]io.Closer{resp.Body}, layers.c...)}
+	resp.ContentLength = length
+	resp.Uncompressed = true
+	return nil
+}
+
 //
 
+// preferredEncodings is the order in which well known encodings are
+// advertised. Tell the server we prefer zstd.
+var preferredEncodings = []string{"zstd", "br", "gzip"}
+
+// acceptEncoding returns the Accept-Encoding value to send.
+//
+// When Encodings is unset, well known encodings come first in
+// preferredEncodings order, then the rest sorted alphabetically so the header
+// is deterministic.
+func (a *AcceptCompressed) acceptEncoding(decoders map[string]Decoder) (string, error) {
+	encodings := a.Encodings
+	if encodings == nil {
+		for _, n := range preferredEncodings {
+			if decoders[n] != nil {
+				encodings = append(encodings, EncodingWeight{Name: n})
+			}
+		}
+		var others []string
+		for n, d := range decoders {
+			if d != nil && !slices.Contains(preferredEncodings, n) {
+				others = append(others, n)
+			}
+		}
+		slices.Sort(others)
+		for _, n := range others {
+			encodings = append(encodings, EncodingWeight{Name: n})
+		}
+	}
+	parts := make([]string, 0, len(encodings))
+	for _, e := range encodings {
+		if decoders[e.Name] == nil {
+			return "", fmt.Errorf("no Decoder for encoding %q", e.Name)
+		}
+		if e.Q < 0 || e.Q > 1 {
+			return "", fmt.Errorf("invalid q-value %g for encoding %q", e.Q, e.Name)
+		}
+		if e.Q == 0 || e.Q == 1 {
+			parts = append(parts, e.Name)
+		} else {
+			parts = append(parts, e.Name+";q="+formatQ(e.Q))
+		}
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+// formatQ formats a q-value with at most 3 decimals as required by RFC 9110.
+func formatQ(q float64) string {
+	s := strings.TrimRight(strconv.FormatFloat(q, 'f', 3, 64), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header value. Entries without
+// a q-value get a weight of 1 and invalid q-values a weight of 0.
+func parseAcceptEncoding(s string) []EncodingWeight {
+	var out []EncodingWeight
+	for part := range strings.SplitSeq(s, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		e := EncodingWeight{Name: name, Q: 1}
+		for p := range strings.SplitSeq(params, ";") {
+			k, v, _ := strings.Cut(p, "=")
+			if strings.EqualFold(strings.TrimSpace(k), "q") {
+				q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				if err != nil || q < 0 || q > 1 {
+					q = 0
+				}
+				e.Q = q
+			}
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// accepts returns true if the encoding is acceptable according to the parsed
+// Accept-Encoding, including via the "*" wildcard.
+func accepts(advertised []EncodingWeight, name string) bool {
+	wildcard := false
+	for _, e := range advertised {
+		if e.Name == name {
+			return e.Q > 0
+		}
+		if e.Name == "*" {
+			wildcard = e.Q > 0
+		}
+	}
+	return wildcard
+}
+
+// parseContentEncoding returns the codings in the order they were applied,
+// skipping "identity".
+func parseContentEncoding(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for c := range strings.SplitSeq(v, ",") {
+			if c = strings.ToLower(strings.TrimSpace(c)); c != "" && c != "identity" {
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}
+
+// Decoders are pooled since they are expensive to create, especially zstd.
+
+var (
+	brotliDecoderPool sync.Pool
+	gzipDecoderPool   sync.Pool
+	zstdDecoderPool   sync.Pool
+)
+
+func newBrotliDecoder(r io.Reader) (io.ReadCloser, error) {
+	br, _ := brotliDecoderPool.Get().(*brotli.Reader)
+	if br == nil {
+		br = brotli.NewReader(r)
+	} else if err := br.Reset(r); err != nil {
+		return nil, err
+	}
+	return &pooledReader{r: br, pool: &brotliDecoderPool, release: func() { _ = br.Reset(nil) }}, nil
+}
+
+func newGzipDecoder(r io.Reader) (io.ReadCloser, error) {
+	gz, _ := gzipDecoderPool.Get().(*gzip.Reader)
+	if gz == nil {
+		var err error
+		if gz, err = gzip.NewReader(r); err != nil {
+			return nil, err
+		}
+	} else if err := gz.Reset(r); err != nil {
+		gzipDecoderPool.Put(gz)
+		return nil, err
+	}
+	return &pooledReader{r: gz, pool: &gzipDecoderPool, release: func() { _ = gz.Close() }}, nil
+}
+
+func newZstdDecoder(r io.Reader) (io.ReadCloser, error) {
+	zs, _ := zstdDecoderPool.Get().(*zstd.Decoder)
+	if zs == nil {
+		// RFC 9659 limits the window to 8MiB for the "zstd" content coding. Enforce
+		// it so a hostile server cannot make us allocate a huge window. A
+		// concurrency of 1 decodes synchronously without starting goroutines,
+		// which makes the decoder safe to keep in a sync.Pool.
+		var err error
+		if zs, err = zstd.NewReader(r, zstd.WithDecoderMaxWindow(8<<20), zstd.WithDecoderConcurrency(1)); err != nil {
+			return nil, err
+		}
+	} else if err := zs.Reset(r); err != nil {
+		zstdDecoderPool.Put(zs)
+		return nil, err
+	}
+	return &adapter{zs: zs}, nil
+}
+
+var errReadAfterClose = errors.New("read after Close")
+
+var errBodyTooLong = errors.New("decoded body longer than Content-Length")
+
 type adapter struct {
 	zs *zstd.Decoder
 }
 
+func (a *adapter) Read(p []byte) (int, error) {
+	if a.zs == nil {
+		return 0, errReadAfterClose
+	}
+	return a.zs.Read(p)
+}
+
 func (a *adapter) Close() error {
-	// zstd.Decoder doesn't implement io.Closer. :/
-	a.zs.Close()
+	// zstd.Decoder doesn't implement io.Closer. :/ Return it to the pool
+	// instead, without keeping a reference to the response body.
+	if a.zs != nil {
+		_ = a.zs.Reset(nil)
+		zstdDecoderPool.Put(a.zs)
+		a.zs = nil
+	}
+	return nil
+}
+
+// pooledReader returns the decoder to its pool on Close.
+type pooledReader struct {
+	r       io.Reader
+	pool    *sync.Pool
+	release func()
+}
+
+func (p *pooledReader) Read(b []byte) (int, error) {
+	if p.r == nil {
+		return 0, errReadAfterClose
+	}
+	return p.r.Read(b)
+}
+
+func (p *pooledReader) Close() error {
+	if p.r != nil {
+		p.release()
+		p.pool.Put(p.r)
+		p.r = nil
+	}
 	return nil
 }
 
@@ -104,3 +506,76 @@ func (b *body) Close() error {
 	}
 	return errors.Join(errs...)
 }
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// limitedReader enforces AcceptCompressed decompression limits.
+type limitedReader struct {
+	r        io.Reader
+	wire     *countingReader
+	maxBytes int64
+	maxRatio float64
+	n        int64
+	err      error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.maxBytes > 0 && l.n > l.maxBytes {
+		n -= int(l.n - l.maxBytes)
+		l.err = &DecompressionLimitError{Decompressed: l.n, Compressed: l.wire.n, MaxBytes: l.maxBytes, MaxRatio: l.maxRatio}
+		return n, l.err
+	}
+	if l.maxRatio > 0 && l.n >= 64<<10 && float64(l.n) > l.maxRatio*float64(l.wire.n) {
+		l.err = &DecompressionLimitError{Decompressed: l.n, Compressed: l.wire.n, MaxBytes: l.maxBytes, MaxRatio: l.maxRatio}
+		return n, l.err
+	}
+	return n, err
+}
+
+// lengthReader returns io.ErrUnexpectedEOF if the decoded body is shorter than
+// the announced length, like the standard library does with Content-Length, and
+// errBodyTooLong if it is longer.
+type lengthReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Make sure there is no data past the announced length.
+		var b [1]byte
+		for {
+			n, err := l.r.Read(b[:])
+			if n > 0 {
+				return 0, errBodyTooLong
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if err == io.EOF && l.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
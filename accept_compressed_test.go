@@ -5,11 +5,17 @@
 package roundtrippers_test
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
+	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/zstd"
 	"github.com/maruel/roundtrippers"
 )
@@ -97,9 +103,434 @@ func TestAcceptCompressed_error_bad(t *testing.T) {
 	}
 }
 
+func TestAcceptCompressed_Decoders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ae := r.Header.Get("Accept-Encoding"); ae != "gzip, deflate" {
+			http.Error(w, "unexpected Accept-Encoding "+ae, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Encoding", "deflate")
+		c, err := flate.NewWriter(w, flate.BestSpeed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = c.Write([]byte("excellent"))
+		if err = c.Close(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}))
+	defer ts.Close()
+
+	decoders := map[string]roundtrippers.Decoder{
+		"gzip": roundtrippers.DefaultDecoders["gzip"],
+		"deflate": func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	}
+	c := http.Client{Transport: &roundtrippers.AcceptCompressed{Transport: http.DefaultTransport, Decoders: decoders}}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "excellent" {
+		t.Fatal(s)
+	}
+}
+
+func TestAcceptCompressed_stacked(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Apply gzip first, then br.
+		w.Header().Set("Content-Encoding", "gzip, br")
+		br := brotli.NewWriter(w)
+		gz := gzip.NewWriter(br)
+		_, _ = gz.Write([]byte("excellent"))
+		if err := gz.Close(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := br.Close(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}))
+	defer ts.Close()
+
+	c := http.Client{Transport: &roundtrippers.AcceptCompressed{Transport: http.DefaultTransport}}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err2 := resp.Body.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "excellent" {
+		t.Fatal(s)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		t.Fatal(ce)
+	}
+}
+
+func TestAcceptCompressed_error_too_many_layers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip, gzip")
+		_, _ = w.Write([]byte("excellent"))
+	}))
+	defer ts.Close()
+
+	c := http.Client{Transport: &roundtrippers.AcceptCompressed{Transport: http.DefaultTransport, MaxLayers: 1}}
+	resp, err := c.Get(ts.URL)
+	if resp != nil || err == nil {
+		t.Fatal(resp, err)
+	}
+}
+
+func TestAcceptCompressed_Encodings(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Encoding")))
+	}))
+	defer ts.Close()
+
+	a := &roundtrippers.AcceptCompressed{
+		Transport: http.DefaultTransport,
+		Encodings: []roundtrippers.EncodingWeight{{Name: "br"}, {Name: "zstd", Q: 0.8}, {Name: "gzip", Q: 0.125}},
+	}
+	c := http.Client{Transport: a}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "br, zstd;q=0.8, gzip;q=0.125" {
+		t.Fatal(s)
+	}
+
+	a.Encodings = []roundtrippers.EncodingWeight{{Name: "compress"}}
+	if resp, err = c.Get(ts.URL); resp != nil || err == nil {
+		t.Fatal(resp, err)
+	}
+}
+
+func TestAcceptCompressed_KeepAcceptEncoding(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ae := r.Header.Get("Accept-Encoding"); ae != "identity" {
+			http.Error(w, "unexpected Accept-Encoding "+ae, http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte("excellent"))
+	}))
+	defer ts.Close()
+
+	c := http.Client{Transport: &roundtrippers.AcceptCompressed{Transport: http.DefaultTransport, KeepAcceptEncoding: true}}
+	req, err := http.NewRequestWithContext(t.Context(), "GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "excellent" || resp.StatusCode != 200 {
+		t.Fatal(resp.StatusCode, s)
+	}
+}
+
+func TestAcceptCompressed_unadvertised(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write([]byte("excellent"))
+		_ = gz.Close()
+	}))
+	defer ts.Close()
+
+	a := &roundtrippers.AcceptCompressed{
+		Transport: http.DefaultTransport,
+		Encodings: []roundtrippers.EncodingWeight{{Name: "zstd"}},
+	}
+	c := http.Client{Transport: a}
+	resp, err := c.Get(ts.URL)
+	if resp != nil || err == nil {
+		t.Fatal(resp, err)
+	}
+
+	a.AllowUnknown = true
+	if resp, err = c.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" || resp.Uncompressed {
+		t.Fatal(ce, resp.Uncompressed)
+	}
+	if s := string(decompGZIP(t, resp.Body)); s != "excellent" {
+		t.Fatal(s)
+	}
+}
+
+func TestAcceptCompressed_MaxDecompressedBytes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "zstd")
+		c, err := zstd.NewWriter(w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = c.Write(make([]byte, 10<<20))
+		_ = c.Close()
+	}))
+	defer ts.Close()
+
+	data := []struct {
+		name string
+		a    roundtrippers.AcceptCompressed
+	}{
+		{"bytes", roundtrippers.AcceptCompressed{Transport: http.DefaultTransport, MaxDecompressedBytes: 1 << 20}},
+		{"ratio", roundtrippers.AcceptCompressed{Transport: http.DefaultTransport, MaxRatio: 100}},
+	}
+	for _, line := range data {
+		t.Run(line.name, func(t *testing.T) {
+			c := http.Client{Transport: &line.a}
+			resp, err := c.Get(ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			var lerr *roundtrippers.DecompressionLimitError
+			if !errors.As(err, &lerr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if line.a.MaxDecompressedBytes != 0 && len(b) != 1<<20 {
+				t.Fatalf("unexpected length %d", len(b))
+			}
+			if len(b) >= 10<<20 {
+				t.Fatalf("unexpected length %d", len(b))
+			}
+		})
+	}
+}
+
+func TestAcceptCompressed_ContentLength(t *testing.T) {
+	content := bytes.Repeat([]byte("excellent "), 100)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fcs":
+			// EncodeAll includes the content size in the frame header.
+			zs, err := zstd.NewWriter(nil)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Encoding", "zstd")
+			_, _ = w.Write(zs.EncodeAll(content, nil))
+		case "/frames":
+			// Concatenated frames are valid zstd but the first frame header only
+			// has the size of the first frame, so the length is unknown.
+			zs, err := zstd.NewWriter(nil)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Encoding", "zstd")
+			_, _ = w.Write(zs.EncodeAll(content[:400], nil))
+			_, _ = w.Write(zs.EncodeAll(content[400:], nil))
+		case "/hint":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("X-Uncompressed-Content-Length", strconv.Itoa(len(content)))
+			gz := gzip.NewWriter(w)
+			_, _ = gz.Write(content)
+			_ = gz.Close()
+		case "/short":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("X-Uncompressed-Content-Length", strconv.Itoa(len(content)+1))
+			gz := gzip.NewWriter(w)
+			_, _ = gz.Write(content)
+			_ = gz.Close()
+		default:
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			_, _ = gz.Write(content)
+			_ = gz.Close()
+		}
+	}))
+	defer ts.Close()
+
+	c := http.Client{Transport: &roundtrippers.AcceptCompressed{
+		Transport:                http.DefaultTransport,
+		UncompressedLengthHeader: "X-Uncompressed-Content-Length",
+	}}
+	data := []struct {
+		path   string
+		length int64
+		err    string
+		want   []byte
+	}{
+		{"/fcs", int64(len(content)), "", content},
+		{"/frames", -1, "", content},
+		{"/hint", int64(len(content)), "", content},
+		{"/unknown", -1, "", content},
+		{"/short", int64(len(content)) + 1, io.ErrUnexpectedEOF.Error(), content},
+	}
+	for _, line := range data {
+		t.Run(line.path, func(t *testing.T) {
+			resp, err := c.Get(ts.URL + line.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if (err == nil) != (line.err == "") || (err != nil && err.Error() != line.err) {
+				t.Fatal(err)
+			}
+			if resp.ContentLength != line.length {
+				t.Fatalf("want %d, got %d", line.length, resp.ContentLength)
+			}
+			if !bytes.Equal(b, line.want) {
+				t.Fatal(string(b))
+			}
+		})
+	}
+}
+
+func TestAcceptCompressed_KeepCompressed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptCompressed(r, "zstd") {
+			http.Error(w, "sorry, I only talk zstd", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Encoding", "zstd")
+		c, err := zstd.NewWriter(w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = c.Write([]byte("excellent"))
+		_ = c.Close()
+	}))
+	defer ts.Close()
+
+	a := &roundtrippers.AcceptCompressed{Transport: http.DefaultTransport, KeepCompressed: true}
+	c := http.Client{Transport: a}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "zstd" || resp.Uncompressed {
+		t.Fatal(ce, resp.Uncompressed)
+	}
+	if err = a.Decompress(resp); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "excellent" || !resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatal(s)
+	}
+}
+
 func TestAcceptCompressed_Unwrap(t *testing.T) {
 	var r http.RoundTripper = &roundtrippers.AcceptCompressed{Transport: http.DefaultTransport}
 	if r.(roundtrippers.Unwrapper).Unwrap() != http.DefaultTransport {
 		t.Fatal("unexpected")
 	}
 }
+
+func BenchmarkAcceptCompressed(b *testing.B) {
+	content := bytes.Repeat([]byte("excellent "), 1000)
+	var buf bytes.Buffer
+	br := brotli.NewWriter(&buf)
+	_, _ = br.Write(content)
+	_ = br.Close()
+	brContent := bytes.Clone(buf.Bytes())
+	buf.Reset()
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write(content)
+	_ = gz.Close()
+	gzContent := bytes.Clone(buf.Bytes())
+	buf.Reset()
+	zs, _ := zstd.NewWriter(&buf)
+	_, _ = zs.Write(content)
+	_ = zs.Close()
+	zsContent := bytes.Clone(buf.Bytes())
+
+	// The unpooled decoders are the baseline to compare allocations against.
+	unpooled := map[string]roundtrippers.Decoder{
+		"br": func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(brotli.NewReader(r)), nil
+		},
+		"gzip": func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		"zstd": func(r io.Reader) (io.ReadCloser, error) {
+			zs, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return zs.IOReadCloser(), nil
+		},
+	}
+	data := []struct {
+		encoding string
+		content  []byte
+	}{
+		{"br", brContent},
+		{"gzip", gzContent},
+		{"zstd", zsContent},
+	}
+	for _, line := range data {
+		for _, pooled := range []bool{true, false} {
+			name := line.encoding + "/pooled"
+			var decoders map[string]roundtrippers.Decoder
+			if !pooled {
+				name = line.encoding + "/unpooled"
+				decoders = unpooled
+			}
+			b.Run(name, func(b *testing.B) {
+				a := &roundtrippers.AcceptCompressed{
+					Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+						h := http.Header{"Content-Encoding": []string{line.encoding}}
+						return &http.Response{StatusCode: 200, Header: h, Body: io.NopCloser(bytes.NewReader(line.content))}, nil
+					}),
+					Decoders: decoders,
+				}
+				req := httptest.NewRequest("GET", "http://localhost", nil)
+				b.ReportAllocs()
+				for b.Loop() {
+					resp, err := a.RoundTrip(req)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err = io.Copy(io.Discard, resp.Body); err != nil {
+						b.Fatal(err)
+					}
+					if err = resp.Body.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -17,6 +17,9 @@ type Record struct {
 	Response *http.Response
 	// Err is the error returned by the http.RoundTripper.Do(), if any.
 	Err error
+	// Attempt is the try number when wrapped by Retry, starting at 1. It is 0
+	// otherwise.
+	Attempt int
 
 	_ struct{}
 }
@@ -38,6 +41,7 @@ func (c *Capture) RoundTrip(req *http.Request) (*http.Response, error) {
 			return nil, err
 		}
 	}
+	attempt := RetryAttempt(req.Context())
 	resp, err := c.Transport.RoundTrip(req)
 	if resp != nil {
 		// Make a copy of the response.
@@ -49,9 +53,10 @@ func (c *Capture) RoundTrip(req *http.Request) (*http.Response, error) {
 			resp:    resp2,
 			c:       c.C,
 			content: &bytes.Buffer{},
+			attempt: attempt,
 		}
 	} else {
-		c.C <- Record{Request: req, Err: err}
+		c.C <- Record{Request: req, Err: err, Attempt: attempt}
 	}
 	return resp, err
 }
@@ -69,6 +74,7 @@ type captureBody struct {
 	c       chan<- Record
 	content *bytes.Buffer
 	err     error
+	attempt int
 }
 
 func (c *captureBody) Read(p []byte) (int, error) {
@@ -84,6 +90,6 @@ func (c *captureBody) Close() error {
 	err := c.body.Close()
 	c.resp.Body = io.NopCloser(c.content)
 	// The Request object in the Response may be different from what we saved.
-	c.c <- Record{Request: c.req, Response: c.resp, Err: c.err}
+	c.c <- Record{Request: c.req, Response: c.resp, Err: c.err, Attempt: c.attempt}
 	return err
 }
@@ -0,0 +1,207 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CircuitBreaker fails fast with ErrCircuitOpen when a server keeps failing,
+// to not hammer a dependency that is down.
+//
+// Each circuit starts closed. After FailureThreshold consecutive failures, it
+// opens and requests fail fast. After OpenDuration, it becomes half-open and a
+// single trial request is sent; its success closes the circuit and its failure
+// opens it again.
+//
+// Place it inside Retry so that each try is accounted for.
+type CircuitBreaker struct {
+	Transport http.RoundTripper
+	// Key returns the circuit of a request. Defaults to the URL host.
+	Key func(req *http.Request) string
+	// IsFailure determines if a response or an error is a failure. Defaults to
+	// the HTTP status codes retried by DefaultRetryPolicy and the errors it
+	// retries on a replayable request, see ErrorClass.Retriable. Errors that are
+	// not failures, like a canceled context, are ignored.
+	IsFailure func(resp *http.Response, err error) bool
+	// FailureThreshold is the number of consecutive failures that opens the
+	// circuit. Defaults to 5.
+	FailureThreshold int
+	// OpenDuration is the time the circuit stays open before sending a trial
+	// request. Defaults to 30s.
+	OpenDuration time.Duration
+	// OnStateChange is optionally called when a circuit changes state.
+	OnStateChange func(key string, from, to CircuitState)
+	// Now can be hooked for unit tests. It defaults to time.Now().
+	Now func() time.Time
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// CircuitState is the state of a circuit in a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails requests fast.
+	CircuitOpen
+	// CircuitHalfOpen lets a single trial request through.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "CircuitState(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// ErrCircuitOpen is returned by CircuitBreaker when the circuit is open.
+var ErrCircuitOpen = errors.New("roundtrippers.CircuitBreaker: circuit open")
+
+// RoundTrip implements http.RoundTripper.
+func (c *CircuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.URL.Host
+	if c.Key != nil {
+		key = c.Key(req)
+	}
+	allowed, trial := c.allow(key)
+	if !allowed {
+		return nil, ErrCircuitOpen
+	}
+	resp, err := c.Transport.RoundTrip(req)
+	failed := false
+	if c.IsFailure != nil {
+		failed = c.IsFailure(resp, err)
+	} else if err != nil {
+		// Count the errors that denote an unhealthy server, whether or not this
+		// request could be retried.
+		failed = Classify(err).Retriable(true)
+	} else {
+		failed = isRetriableStatus(resp.StatusCode)
+	}
+	c.done(key, trial, failed, !failed && err != nil)
+	return resp, err
+}
+
+// State returns the current state of a circuit.
+func (c *CircuitBreaker) State(key string) CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ci := c.circuits[key]; ci != nil {
+		return ci.state
+	}
+	return CircuitClosed
+}
+
+// Unwrap implements Unwrapper.
+func (c *CircuitBreaker) Unwrap() http.RoundTripper {
+	return c.Transport
+}
+
+//
+
+type circuit struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// allow returns true if a request can be sent and if it is the trial request
+// of a half-open circuit.
+func (c *CircuitBreaker) allow(key string) (bool, bool) {
+	c.mu.Lock()
+	ci := c.circuits[key]
+	if ci == nil {
+		if c.circuits == nil {
+			c.circuits = map[string]*circuit{}
+		}
+		ci = &circuit{}
+		c.circuits[key] = ci
+	}
+	from := ci.state
+	if ci.state == CircuitOpen && c.now().Sub(ci.openedAt) >= c.openDuration() {
+		ci.state = CircuitHalfOpen
+	}
+	allowed, trial := true, false
+	if ci.state == CircuitOpen || (ci.state == CircuitHalfOpen && ci.trial) {
+		allowed = false
+	} else if ci.state == CircuitHalfOpen {
+		ci.trial = true
+		trial = true
+	}
+	to := ci.state
+	c.mu.Unlock()
+	c.notify(key, from, to)
+	return allowed, trial
+}
+
+// done records the outcome of a request. A neutral outcome, e.g. a canceled
+// request, doesn't change the state. Only the trial request can change the
+// state of a half-open circuit; the outcomes of requests sent before the circuit
+// opened are ignored.
+func (c *CircuitBreaker) done(key string, trial, failed, neutral bool) {
+	c.mu.Lock()
+	ci := c.circuits[key]
+	from := ci.state
+	if trial {
+		ci.trial = false
+	}
+	switch {
+	case neutral || (from != CircuitClosed && !trial):
+	case failed:
+		ci.failures++
+		if trial || ci.failures >= c.failureThreshold() {
+			ci.state = CircuitOpen
+			ci.openedAt = c.now()
+		}
+	default:
+		ci.failures = 0
+		ci.state = CircuitClosed
+	}
+	to := ci.state
+	c.mu.Unlock()
+	c.notify(key, from, to)
+}
+
+func (c *CircuitBreaker) notify(key string, from, to CircuitState) {
+	if from != to && c.OnStateChange != nil {
+		c.OnStateChange(key, from, to)
+	}
+}
+
+func (c *CircuitBreaker) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+func (c *CircuitBreaker) failureThreshold() int {
+	if c.FailureThreshold <= 0 {
+		return 5
+	}
+	return c.FailureThreshold
+}
+
+func (c *CircuitBreaker) openDuration() time.Duration {
+	if c.OpenDuration <= 0 {
+		return 30 * time.Second
+	}
+	return c.OpenDuration
+}
@@ -0,0 +1,148 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var count atomic.Int64
+	var code atomic.Int64
+	code.Store(503)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		w.WriteHeader(int(code.Load()))
+	}))
+	defer ts.Close()
+	now := time.Now()
+	type change struct {
+		from, to CircuitState
+	}
+	var changes []change
+	cb := &CircuitBreaker{
+		Transport:        http.DefaultTransport,
+		FailureThreshold: 2,
+		OpenDuration:     time.Minute,
+		Now:              func() time.Time { return now },
+		OnStateChange: func(key string, from, to CircuitState) {
+			changes = append(changes, change{from, to})
+		},
+	}
+	c := http.Client{Transport: cb}
+	get := func(want int) {
+		t.Helper()
+		resp, err := c.Get(ts.URL)
+		if want == 0 {
+			if !errors.Is(err, ErrCircuitOpen) {
+				t.Fatalf("expected ErrCircuitOpen, got %v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatal(resp.StatusCode)
+		}
+	}
+	key := ts.Listener.Addr().String()
+	get(503)
+	if s := cb.State(key); s != CircuitClosed {
+		t.Fatal(s)
+	}
+	get(503)
+	if s := cb.State(key); s != CircuitOpen {
+		t.Fatal(s)
+	}
+	get(0)
+	if v := count.Load(); v != 2 {
+		t.Fatalf("expected 2 requests, got %d", v)
+	}
+	// The trial request fails and opens the circuit again.
+	now = now.Add(time.Minute)
+	get(503)
+	get(0)
+	// The trial request succeeds and closes the circuit.
+	now = now.Add(time.Minute)
+	code.Store(200)
+	get(200)
+	get(200)
+	if s := cb.State(key); s != CircuitClosed {
+		t.Fatal(s)
+	}
+	want := []change{
+		{CircuitClosed, CircuitOpen},
+		{CircuitOpen, CircuitHalfOpen},
+		{CircuitHalfOpen, CircuitOpen},
+		{CircuitOpen, CircuitHalfOpen},
+		{CircuitHalfOpen, CircuitClosed},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("want %v, got %v", want, changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, changes)
+		}
+	}
+}
+
+func TestCircuitBreaker_Key(t *testing.T) {
+	errFail := errors.New("fail")
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/canceled" {
+			return nil, context.Canceled
+		}
+		return nil, errFail
+	})
+	cb := &CircuitBreaker{
+		Transport:        rt,
+		Key:              func(req *http.Request) string { return req.URL.Path },
+		IsFailure:        func(resp *http.Response, err error) bool { return errors.Is(err, errFail) },
+		FailureThreshold: 1,
+	}
+	c := http.Client{Transport: cb}
+	for range 3 {
+		if _, err := c.Get("http://localhost/canceled"); !errors.Is(err, context.Canceled) {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Get("http://localhost/a"); !errors.Is(err, errFail) {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("http://localhost/a"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatal(err)
+	}
+	if s := cb.State("/canceled"); s != CircuitClosed {
+		t.Fatal(s)
+	}
+	if s := cb.State("/b"); s != CircuitClosed {
+		t.Fatal(s)
+	}
+}
+
+func TestCircuitState_String(t *testing.T) {
+	if s := CircuitHalfOpen.String(); s != "half-open" {
+		t.Fatal(s)
+	}
+	if s := CircuitState(10).String(); s != "CircuitState(10)" {
+		t.Fatal(s)
+	}
+}
+
+func TestCircuitBreaker_Unwrap(t *testing.T) {
+	var r http.RoundTripper = &CircuitBreaker{Transport: http.DefaultTransport}
+	if r.(Unwrapper).Unwrap() != http.DefaultTransport {
+		t.Fatal("unexpected")
+	}
+}
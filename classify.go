@@ -0,0 +1,232 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"syscall"
+)
+
+// ErrorClass is the category of an error returned by a http.RoundTripper, as
+// determined by Classify.
+type ErrorClass int
+
+const (
+	// ErrorNone means there was no error.
+	ErrorNone ErrorClass = iota
+	// ErrorUnknown is an error that could not be classified.
+	ErrorUnknown
+	// ErrorCanceled is a context cancellation or deadline from the caller.
+	ErrorCanceled
+	// ErrorAttemptTimeout is ErrAttemptTimeout.
+	ErrorAttemptTimeout
+	// ErrorTimeout is a network timeout.
+	ErrorTimeout
+	// ErrorConnRefused is a refused TCP connection. The request was not sent.
+	ErrorConnRefused
+	// ErrorConnReset is a connection reset or broken pipe.
+	ErrorConnReset
+	// ErrorUnexpectedEOF is a connection closed before the response was
+	// received.
+	ErrorUnexpectedEOF
+	// ErrorDNS is a temporary DNS resolution failure.
+	ErrorDNS
+	// ErrorDNSNotFound is a host that doesn't exist.
+	ErrorDNSNotFound
+	// ErrorHTTP2 is an HTTP/2 GOAWAY or a stream refused or reset by the server.
+	ErrorHTTP2
+	// ErrorTLS is a TLS handshake or certificate verification failure.
+	ErrorTLS
+	// ErrorRequest is a request that net/http refuses to send, e.g. an
+	// unsupported scheme, an invalid header or too many redirects.
+	ErrorRequest
+)
+
+// Retriable returns true if the request may succeed if tried again. It is the
+// rule used by ExponentialBackoff.
+//
+// replayable is true when it is safe to send the request again, e.g. it has an
+// idempotent method or an Idempotency-Key header. It is needed when the server
+// may have processed the request before the error.
+func (c ErrorClass) Retriable(replayable bool) bool {
+	switch c {
+	case ErrorConnRefused, ErrorHTTP2:
+		// The server didn't process the request.
+		return true
+	case ErrorAttemptTimeout, ErrorTimeout, ErrorConnReset, ErrorUnexpectedEOF:
+		return replayable
+	default:
+		return false
+	}
+}
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorNone:
+		return "none"
+	case ErrorUnknown:
+		return "unknown"
+	case ErrorCanceled:
+		return "canceled"
+	case ErrorAttemptTimeout:
+		return "attempt_timeout"
+	case ErrorTimeout:
+		return "timeout"
+	case ErrorConnRefused:
+		return "conn_refused"
+	case ErrorConnReset:
+		return "conn_reset"
+	case ErrorUnexpectedEOF:
+		return "unexpected_eof"
+	case ErrorDNS:
+		return "dns"
+	case ErrorDNSNotFound:
+		return "dns_not_found"
+	case ErrorHTTP2:
+		return "http2"
+	case ErrorTLS:
+		return "tls"
+	case ErrorRequest:
+		return "request"
+	default:
+		return "ErrorClass(" + strconv.Itoa(int(c)) + ")"
+	}
+}
+
+// Classify returns the category of an error returned by a http.RoundTripper.
+//
+// It can be used by custom RetryPolicy implementations to decide whether to
+// retry.
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return ErrorNone
+	}
+	if errors.Is(err, ErrAttemptTimeout) {
+		return ErrorAttemptTimeout
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorCanceled
+	}
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var certInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	if errors.As(err, &certErr) || errors.As(err, &unknownAuthErr) || errors.As(err, &certInvalidErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr) {
+		return ErrorTLS
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return ErrorDNSNotFound
+		}
+		return ErrorDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrorConnRefused
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return ErrorConnReset
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return ErrorUnexpectedEOF
+	}
+	var streamErr http2StreamError
+	if errors.As(err, &streamErr) {
+		if streamErr.Code == http2ErrCodeInternal || streamErr.Code == http2ErrCodeRefusedStream {
+			return ErrorHTTP2
+		}
+		return ErrorUnknown
+	}
+	if isHTTP2GoAway(err) {
+		return ErrorHTTP2
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorTimeout
+	}
+	if s := err.Error(); redirectsErrorRe.MatchString(s) || schemeErrorRe.MatchString(s) || invalidHeaderErrorRe.MatchString(s) {
+		return ErrorRequest
+	} else if notTrustedErrorRe.MatchString(s) {
+		return ErrorTLS
+	}
+	return ErrorUnknown
+}
+
+//
+
+// http2StreamError mirrors golang.org/x/net/http2.StreamError. The StreamError
+// bundled in net/http implements As() to convert to any struct with these
+// fields, which avoids matching on its error string.
+type http2StreamError struct {
+	StreamID uint32
+	Code     uint32
+	Cause    error
+}
+
+func (e http2StreamError) Error() string {
+	return "stream error"
+}
+
+const (
+	http2ErrCodeInternal      = 0x2
+	http2ErrCodeRefusedStream = 0x7
+)
+
+// isHTTP2GoAway returns true if err wraps the GoAwayError bundled in
+// net/http. It is not exported and has no As() method, so the type name is
+// used instead.
+func isHTTP2GoAway(err error) bool {
+	for _, e := range unwrapAll(err) {
+		if t := reflect.TypeOf(e); t.Kind() == reflect.Struct && (t.Name() == "http2GoAwayError" || t.Name() == "GoAwayError") {
+			return true
+		}
+	}
+	return false
+}
+
+// unwrapAll returns err and all the errors it wraps.
+func unwrapAll(err error) []error {
+	var out []error
+	for stack := []error{err}; len(stack) != 0; {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if e == nil {
+			continue
+		}
+		out = append(out, e)
+		switch x := e.(type) {
+		case interface{ Unwrap() error }:
+			stack = append(stack, x.Unwrap())
+		case interface{ Unwrap() []error }:
+			stack = append(stack, x.Unwrap()...)
+		}
+	}
+	return out
+}
+
+// List of regexes used to match errors returned by net/http. These are not typed specifically so we resort to
+// matching on the error string. This is not ideal.
+var (
+	// redirectsErrorRe matches the error returned by net/http when the configured number of redirects is
+	// exhausted.
+	redirectsErrorRe = regexp.MustCompile(`stopped after \d+ redirects\z`)
+	// schemeErrorRe matches the error returned by net/http when the scheme specified in the URL is invalid.
+	schemeErrorRe = regexp.MustCompile(`unsupported protocol scheme`)
+	// invalidHeaderErrorRe matches the error returned by net/http when a request header or value is invalid.
+	invalidHeaderErrorRe = regexp.MustCompile(`invalid header`)
+	// notTrustedErrorRe matches the error returned on macOS when the TLS certificate is not trusted.
+	notTrustedErrorRe = regexp.MustCompile(`certificate is not trusted`)
+)
@@ -0,0 +1,103 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// GoAwayError has the same name as the GoAwayError bundled in net/http.
+type GoAwayError struct{}
+
+func (GoAwayError) Error() string { return "http2: server sent GOAWAY" }
+
+// fakeStreamError has the same layout as the StreamError bundled in net/http.
+type fakeStreamError struct {
+	StreamID uint32
+	Code     uint32
+	Cause    error
+}
+
+func (e fakeStreamError) Error() string { return "stream error" }
+
+func (e fakeStreamError) As(target any) bool {
+	if p, ok := target.(*http2StreamError); ok {
+		*p = http2StreamError(e)
+		return true
+	}
+	return false
+}
+
+func TestClassify(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://localhost", Err: err}
+	}
+	sysErr := func(errno syscall.Errno) error {
+		return wrap(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)})
+	}
+	data := []struct {
+		err  error
+		want ErrorClass
+	}{
+		{nil, ErrorNone},
+		{errors.New("foo"), ErrorUnknown},
+		{wrap(context.Canceled), ErrorCanceled},
+		{wrap(context.DeadlineExceeded), ErrorCanceled},
+		{ErrAttemptTimeout, ErrorAttemptTimeout},
+		{wrap(&net.OpError{Op: "read", Err: &timeoutError{}}), ErrorTimeout},
+		{sysErr(syscall.ECONNREFUSED), ErrorConnRefused},
+		{sysErr(syscall.ECONNRESET), ErrorConnReset},
+		{sysErr(syscall.EPIPE), ErrorConnReset},
+		{wrap(io.ErrUnexpectedEOF), ErrorUnexpectedEOF},
+		{fmt.Errorf("net/http: HTTP/1.x transport connection broken: %w", io.EOF), ErrorUnexpectedEOF},
+		{wrap(&net.DNSError{Err: "server misbehaving", IsTemporary: true}), ErrorDNS},
+		{wrap(&net.DNSError{Err: "no such host", IsNotFound: true}), ErrorDNSNotFound},
+		{wrap(fakeStreamError{StreamID: 1, Code: http2ErrCodeInternal}), ErrorHTTP2},
+		{wrap(fakeStreamError{StreamID: 1, Code: http2ErrCodeRefusedStream}), ErrorHTTP2},
+		{wrap(fakeStreamError{StreamID: 1, Code: 0x8}), ErrorUnknown},
+		{wrap(GoAwayError{}), ErrorHTTP2},
+		{wrap(x509.UnknownAuthorityError{}), ErrorTLS},
+		{wrap(x509.HostnameError{Certificate: &x509.Certificate{}, Host: "localhost"}), ErrorTLS},
+		{wrap(errors.New("stopped after 10 redirects")), ErrorRequest},
+		{wrap(errors.New(`unsupported protocol scheme "foo"`)), ErrorRequest},
+	}
+	for i, line := range data {
+		if got := Classify(line.err); got != line.want {
+			t.Errorf("#%d: Classify(%v) = %s, want %s", i, line.err, got, line.want)
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	if !ErrorConnReset.Retriable(true) || ErrorConnReset.Retriable(false) || !ErrorConnRefused.Retriable(false) {
+		t.Fatal("unexpected")
+	}
+	if ErrorDNS.Retriable(true) || ErrorTLS.Retriable(true) || ErrorUnknown.Retriable(true) {
+		t.Fatal("unexpected")
+	}
+	if s := ErrorHTTP2.String(); s != "http2" {
+		t.Fatal(s)
+	}
+	if s := ErrorClass(100).String(); s != "ErrorClass(100)" {
+		t.Fatal(s)
+	}
+}
+
+//
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,257 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// CompressedHandler is a http.Handler middleware that is the server side
+// counterpart of PostCompressed and AcceptCompressed.
+//
+// It decompresses request bodies encoded with "br", "deflate", "gzip" or
+// "zstd", and compresses responses according to the request Accept-Encoding.
+//
+// To limit the size of decompressed request bodies, wrap Handler with
+// http.MaxBytesHandler.
+type CompressedHandler struct {
+	Handler http.Handler
+	// Encodings lists the encodings to compress responses with, in order of
+	// server preference when the client gives them the same weight. Each must be
+	// in CompressionLevels.
+	//
+	// If unset, defaults to "zstd", "br" and "gzip".
+	Encodings []string
+	// Level is the compression level for all encodings. It must be valid for
+	// each of Encodings in CompressionLevels. If unset, each encoding uses its
+	// default.
+	Level int
+
+	_ struct{}
+}
+
+// NewCompressedHandler returns a CompressedHandler after validating the
+// encodings and the compression level.
+//
+// It returns an *InvalidEncodingError or an *InvalidLevelError, so
+// configuration can be checked at startup instead of at the first request.
+func NewCompressedHandler(h http.Handler, encodings []string, level int) (*CompressedHandler, error) {
+	c := &CompressedHandler{Handler: h, Encodings: encodings, Level: level}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (c *CompressedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := c.validate(); err != nil {
+		http.Error(w, "roundtrippers.CompressedHandler: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if codings := parseContentEncoding(r.Header.Values("Content-Encoding")); len(codings) != 0 {
+		b := &body{r: r.Body, c: []io.Closer{r.Body}}
+		for i := len(codings) - 1; i >= 0; i-- {
+			d := requestDecoders[codings[i]]
+			if d == nil {
+				_ = b.Close()
+				// RFC 7694 section 3.
+				w.Header().Set("Accept-Encoding", "zstd, br, gzip, deflate")
+				http.Error(w, "unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+				return
+			}
+			rd, err := d(b.r)
+			if err != nil {
+				_ = b.Close()
+				http.Error(w, "invalid compressed body", http.StatusBadRequest)
+				return
+			}
+			b.r = rd
+			b.c = append(b.c, rd)
+		}
+		// net/http only closes the original body, close the decoders so they
+		// go back to their pool.
+		defer func() { _ = b.Close() }()
+		r = r.Clone(r.Context())
+		r.Body = b
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+	}
+	encodings := c.encodings()
+	w.Header().Add("Vary", "Accept-Encoding")
+	enc := negotiateEncoding(parseAcceptEncoding(r.Header.Get("Accept-Encoding")), encodings)
+	if enc == "" || r.Method == "HEAD" {
+		c.Handler.ServeHTTP(w, r)
+		return
+	}
+	cw := &compressedResponseWriter{ResponseWriter: w, k: encoderKey{encoding: enc, level: c.Level}}
+	// An error here means the client went away, there's nothing to do.
+	defer func() { _ = cw.close() }()
+	c.Handler.ServeHTTP(cw, r)
+}
+
+func (c *CompressedHandler) encodings() []string {
+	if c.Encodings == nil {
+		return preferredEncodings
+	}
+	return c.Encodings
+}
+
+func (c *CompressedHandler) validate() error {
+	for _, e := range c.encodings() {
+		cl, ok := CompressionLevels[e]
+		if !ok {
+			return &InvalidEncodingError{Encoding: e}
+		}
+		if c.Level != 0 && (c.Level < cl.Min || c.Level > cl.Max) {
+			return &InvalidLevelError{Encoding: e, Level: c.Level, Min: cl.Min, Max: cl.Max}
+		}
+	}
+	return nil
+}
+
+//
+
+// requestDecoders are the decoders for the encodings PostCompressed produces.
+var requestDecoders = map[string]Decoder{
+	"br":      newBrotliDecoder,
+	"deflate": newDeflateDecoder,
+	"gzip":    newGzipDecoder,
+	"zstd":    newZstdDecoder,
+}
+
+func newDeflateDecoder(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// negotiateEncoding returns the encoding to use for the response, or "" for
+// identity.
+func negotiateEncoding(accepted []EncodingWeight, encodings []string) string {
+	best := ""
+	bestQ := 0.
+	for _, e := range encodings {
+		q := 0.
+		for _, a := range accepted {
+			if a.Name == e {
+				q = a.Q
+				break
+			}
+			if a.Name == "*" {
+				q = a.Q
+			}
+		}
+		if q > bestQ {
+			best = e
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// compressedResponseWriter compresses the response body.
+//
+// The status code is held until the first Write, so the decision to compress
+// can use the Content-Type sniffed from the body.
+type compressedResponseWriter struct {
+	http.ResponseWriter
+	k    encoderKey
+	e    encoder
+	code int
+	sent bool
+}
+
+func (c *compressedResponseWriter) WriteHeader(code int) {
+	if c.sent || code < 200 {
+		// Informational responses are not the final response.
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if c.code == 0 {
+		c.code = code
+	}
+}
+
+func (c *compressedResponseWriter) Write(p []byte) (int, error) {
+	if !c.sent {
+		c.start(p)
+	}
+	if c.e == nil {
+		return c.ResponseWriter.Write(p)
+	}
+	return c.e.Write(p)
+}
+
+// start decides whether to compress and sends the header. p is the start of
+// the body, if any.
+func (c *compressedResponseWriter) start(p []byte) {
+	c.sent = true
+	if c.code == 0 {
+		c.code = http.StatusOK
+	}
+	h := c.Header()
+	// A partial response is a range of the identity representation, it can't be
+	// compressed.
+	partial := c.code == http.StatusPartialContent || h.Get("Content-Range") != ""
+	if c.code != http.StatusNoContent && c.code != http.StatusNotModified && !partial && h.Get("Content-Encoding") == "" {
+		if _, ok := h["Content-Type"]; !ok && len(p) != 0 {
+			// Sniff before compressing, like the standard library would do. It
+			// doesn't sniff once Content-Encoding is set.
+			h.Set("Content-Type", http.DetectContentType(p))
+		}
+		// Without a Content-Type, e.g. on a Flush before the first Write, the
+		// body may already be compressed.
+		if _, ok := h["Content-Type"]; ok && !isIncompressible(h.Get("Content-Type")) {
+			if e, err := getEncoder(c.k); err == nil {
+				e.Reset(c.ResponseWriter)
+				c.e = e
+				h.Set("Content-Encoding", c.k.encoding)
+				h.Del("Content-Length")
+			}
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.code)
+}
+
+// Flush implements http.Flusher.
+func (c *compressedResponseWriter) Flush() {
+	if !c.sent {
+		c.start(nil)
+	}
+	if f, ok := c.e.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	_ = http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap is used by http.ResponseController.
+func (c *compressedResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressedResponseWriter) close() error {
+	if !c.sent && c.code != 0 {
+		// The handler wrote a header without a body, there's nothing to
+		// compress.
+		c.sent = true
+		c.ResponseWriter.WriteHeader(c.code)
+	}
+	if c.e == nil {
+		return nil
+	}
+	err := c.e.Close()
+	putEncoder(c.k, c.e)
+	c.e = nil
+	return err
+}
+
+// isIncompressible returns true for media types that are already compressed.
+func isIncompressible(contentType string) bool {
+	mt, _, _ := strings.Cut(contentType, ";")
+	return matchMediaType(DefaultSkipContentTypes, strings.ToLower(strings.TrimSpace(mt)))
+}
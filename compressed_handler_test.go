@@ -0,0 +1,257 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maruel/roundtrippers"
+)
+
+func TestCompressedHandler(t *testing.T) {
+	ts := httptest.NewServer(&roundtrippers.CompressedHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte(strings.ToUpper(string(b))))
+		}),
+	})
+	defer ts.Close()
+	data := []struct {
+		request  string
+		response string
+	}{
+		{"br", "br"},
+		// The handler doesn't compress responses with deflate by default.
+		{"deflate", "gzip"},
+		{"gzip", "gzip"},
+		{"zstd", "zstd"},
+	}
+	for _, line := range data {
+		t.Run(line.request, func(t *testing.T) {
+			var ce string
+			c := http.Client{Transport: &roundtrippers.PostCompressed{
+				Encoding: line.request,
+				Transport: &roundtrippers.AcceptCompressed{
+					Encodings: []roundtrippers.EncodingWeight{{Name: line.response}},
+					Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+						resp, err := http.DefaultTransport.RoundTrip(req)
+						if resp != nil {
+							ce = resp.Header.Get("Content-Encoding")
+						}
+						return resp, err
+					}),
+				},
+			}}
+			resp, err := c.Post(ts.URL, "text/plain", strings.NewReader("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := string(b); s != "HELLO" {
+				t.Fatal(resp.StatusCode, s)
+			}
+			if ce != line.response {
+				t.Fatalf("want %q, got %q", line.response, ce)
+			}
+		})
+	}
+}
+
+func TestCompressedHandler_negotiation(t *testing.T) {
+	ts := httptest.NewServer(&roundtrippers.CompressedHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/jpeg" {
+				w.Header().Set("Content-Type", "image/jpeg")
+			}
+			_, _ = w.Write([]byte("hello"))
+		}),
+	})
+	defer ts.Close()
+	data := []struct {
+		path string
+		ae   string
+		want string
+	}{
+		{"/", "", ""},
+		{"/", "identity", ""},
+		{"/", "gzip, zstd", "zstd"},
+		{"/", "gzip;q=1, zstd;q=0.5", "gzip"},
+		{"/", "*", "zstd"},
+		{"/", "*, zstd;q=0", "br"},
+		{"/", "deflate", ""},
+		{"/jpeg", "zstd", ""},
+	}
+	for _, line := range data {
+		t.Run(line.path+line.ae, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(t.Context(), "GET", ts.URL+line.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line.ae != "" {
+				req.Header.Set("Accept-Encoding", line.ae)
+			}
+			// Use the raw transport to see the Content-Encoding.
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			if ce := resp.Header.Get("Content-Encoding"); ce != line.want {
+				t.Fatalf("want %q, got %q", line.want, ce)
+			}
+		})
+	}
+}
+
+func TestCompressedHandler_sniff(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 100))
+	ts := httptest.NewServer(&roundtrippers.CompressedHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The Content-Type is unknown when WriteHeader is called.
+			w.WriteHeader(http.StatusOK)
+			if r.URL.Path == "/png" {
+				_, _ = w.Write(png)
+				return
+			}
+			_, _ = w.Write([]byte("hello"))
+		}),
+	})
+	defer ts.Close()
+	data := []struct {
+		path string
+		ct   string
+		ce   string
+	}{
+		{"/png", "image/png", ""},
+		{"/text", "text/plain; charset=utf-8", "zstd"},
+	}
+	for _, line := range data {
+		t.Run(line.path, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(t.Context(), "GET", ts.URL+line.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", "zstd")
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); ct != line.ct {
+				t.Fatalf("want %q, got %q", line.ct, ct)
+			}
+			if ce := resp.Header.Get("Content-Encoding"); ce != line.ce {
+				t.Fatalf("want %q, got %q", line.ce, ce)
+			}
+		})
+	}
+}
+
+func TestCompressedHandler_unsupported(t *testing.T) {
+	ts := httptest.NewServer(&roundtrippers.CompressedHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("unexpected call")
+		}),
+	})
+	defer ts.Close()
+	req, err := http.NewRequestWithContext(t.Context(), "POST", ts.URL, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "compress")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType || resp.Header.Get("Accept-Encoding") == "" {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+}
+
+func TestCompressedHandler_range(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	ts := httptest.NewServer(&roundtrippers.CompressedHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "a.txt", time.Time{}, strings.NewReader(content))
+		}),
+	})
+	defer ts.Close()
+	req, err := http.NewRequestWithContext(t.Context(), "GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=10-19")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatal(resp.StatusCode)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		t.Fatalf("unexpected Content-Encoding %q", ce)
+	}
+	if s := string(b); s != content[10:20] {
+		t.Fatal(s)
+	}
+}
+
+func TestNewCompressedHandler(t *testing.T) {
+	h := http.NotFoundHandler()
+	if _, err := roundtrippers.NewCompressedHandler(h, []string{"gzip"}, 6); err != nil {
+		t.Fatal(err)
+	}
+	_, err := roundtrippers.NewCompressedHandler(h, nil, 6)
+	var lerr *roundtrippers.InvalidLevelError
+	if !errors.As(err, &lerr) || lerr.Encoding != "zstd" {
+		t.Fatal(err)
+	}
+	_, err = roundtrippers.NewCompressedHandler(h, []string{"compress"}, 0)
+	var eerr *roundtrippers.InvalidEncodingError
+	if !errors.As(err, &eerr) {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressedHandler_invalid_level(t *testing.T) {
+	ts := httptest.NewServer(&roundtrippers.CompressedHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("unexpected call")
+		}),
+		Level: 6,
+	})
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatal(resp.StatusCode)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"io"
+	"sync"
+)
+
+// CompressionStats accumulates the bytes saved by AcceptCompressed and
+// PostCompressed, keyed by direction, encoding and host.
+//
+// It is safe for concurrent use and can be shared between multiple
+// RoundTrippers.
+type CompressionStats struct {
+	mu sync.Mutex
+	m  map[CompressionStatsKey]CompressionCount
+}
+
+// CompressionStatsKey is the key of a CompressionStats entry.
+type CompressionStatsKey struct {
+	// Sent is true for request bodies sent by PostCompressed and false for
+	// response bodies received by AcceptCompressed.
+	Sent bool
+	// Encoding is the Content-Encoding, e.g. "zstd".
+	Encoding string
+	// Host is the request URL host.
+	Host string
+}
+
+// CompressionCount is the accumulated statistics for a CompressionStatsKey.
+type CompressionCount struct {
+	// Requests is the number of bodies compressed or decompressed.
+	Requests int64
+	// WireBytes is the number of compressed bytes sent or received.
+	WireBytes int64
+	// DecodedBytes is the number of uncompressed bytes.
+	DecodedBytes int64
+}
+
+// Add records one body.
+func (c *CompressionStats) Add(key CompressionStatsKey, wireBytes, decodedBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = map[CompressionStatsKey]CompressionCount{}
+	}
+	v := c.m[key]
+	v.Requests++
+	v.WireBytes += wireBytes
+	v.DecodedBytes += decodedBytes
+	c.m[key] = v
+}
+
+// Snapshot returns a copy of the current statistics.
+func (c *CompressionStats) Snapshot() map[CompressionStatsKey]CompressionCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[CompressionStatsKey]CompressionCount, len(c.m))
+	for k, v := range c.m {
+		out[k] = v
+	}
+	return out
+}
+
+//
+
+// statsRecorder records a response body in CompressionStats when closed.
+type statsRecorder struct {
+	stats   *CompressionStats
+	key     CompressionStatsKey
+	wire    *countingReader
+	decoded *countingReader
+	done    bool
+}
+
+func (s *statsRecorder) Close() error {
+	if !s.done {
+		s.done = true
+		s.stats.Add(s.key, s.wire.n, s.decoded.n)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
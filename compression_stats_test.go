@@ -0,0 +1,117 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/maruel/roundtrippers"
+)
+
+func TestCompressionStats(t *testing.T) {
+	content := bytes.Repeat([]byte("excellent "), 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			_ = decompZSTD(t, r.Body)
+		}
+		// Use the same encoding in both directions, they must not be merged.
+		w.Header().Set("Content-Encoding", "zstd")
+		zs, err := zstd.NewWriter(w)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, _ = zs.Write(content)
+		_ = zs.Close()
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := &roundtrippers.CompressionStats{}
+	c := http.Client{Transport: &roundtrippers.PostCompressed{
+		Encoding: "zstd",
+		Stats:    stats,
+		Transport: &roundtrippers.AcceptCompressed{
+			Transport: http.DefaultTransport,
+			Stats:     stats,
+		},
+	}}
+	for range 2 {
+		resp, err := c.Post(ts.URL, "text/plain", bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Fatal(string(b))
+		}
+	}
+
+	snap := stats.Snapshot()
+	if len(snap) != 2 {
+		t.Fatalf("%#v", snap)
+	}
+	for _, sent := range []bool{false, true} {
+		v := snap[roundtrippers.CompressionStatsKey{Sent: sent, Encoding: "zstd", Host: u.Host}]
+		if v.Requests != 2 || v.DecodedBytes != 2*int64(len(content)) || v.WireBytes == 0 || v.WireBytes >= v.DecodedBytes {
+			t.Fatalf("sent=%t: %#v", sent, v)
+		}
+	}
+}
+
+func TestCompressionStats_not_sent(t *testing.T) {
+	stats := &roundtrippers.CompressionStats{}
+	c := http.Client{Transport: &roundtrippers.PostCompressed{
+		Transport: http.DefaultTransport,
+		Encoding:  "zstd",
+		Stats:     stats,
+	}}
+	if _, err := c.Post("http://127.0.0.1:0", "text/plain", strings.NewReader("hello")); err == nil {
+		t.Fatal("expected error")
+	}
+	if snap := stats.Snapshot(); len(snap) != 0 {
+		t.Fatalf("%#v", snap)
+	}
+}
+
+func TestCompressionStats_Fallback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "" {
+			http.Error(w, "no thanks", http.StatusUnsupportedMediaType)
+			return
+		}
+	}))
+	defer ts.Close()
+	stats := &roundtrippers.CompressionStats{}
+	c := http.Client{Transport: &roundtrippers.PostCompressed{
+		Transport: http.DefaultTransport,
+		Encoding:  "zstd",
+		Fallback:  true,
+		Stats:     stats,
+	}}
+	resp, err := c.Post(ts.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	// The body was sent uncompressed.
+	if snap := stats.Snapshot(); len(snap) != 0 {
+		t.Fatalf("%#v", snap)
+	}
+}
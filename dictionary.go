@@ -0,0 +1,330 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Dictionary is a compression dictionary as defined by RFC 9842 Compression
+// Dictionary Transport.
+//
+// A server provides it by sending a Use-As-Dictionary header along a response;
+// the response body is the dictionary.
+type Dictionary struct {
+	// Origin is the scheme and host of the URL that provided the dictionary, e.g.
+	// "https://example.com". A dictionary is only used for the same origin.
+	Origin string
+	// Match is the URL path pattern the dictionary applies to. "*" matches any
+	// sequence of characters.
+	Match string
+	// MatchDest is the list of request destinations (Sec-Fetch-Dest) the
+	// dictionary applies to. If empty, it applies to all requests.
+	MatchDest []string
+	// ID is the opaque server provided identifier, sent back in Dictionary-ID.
+	ID string
+	// Hash is the SHA-256 of Content.
+	Hash [32]byte
+	// Content is the dictionary itself.
+	Content []byte
+	// Fetched is when the dictionary was received.
+	Fetched time.Time
+}
+
+// Matches returns true if the dictionary can be advertised for this request.
+func (d *Dictionary) Matches(req *http.Request) bool {
+	if req.URL == nil || req.URL.Scheme+"://"+req.URL.Host != d.Origin {
+		return false
+	}
+	if len(d.MatchDest) != 0 && !slices.Contains(d.MatchDest, req.Header.Get("Sec-Fetch-Dest")) {
+		return false
+	}
+	return matchPattern(d.Match, req.URL.Path)
+}
+
+// DictionaryStore stores compression dictionaries for AcceptCompressed.
+//
+// It must be safe for concurrent use.
+type DictionaryStore interface {
+	// Put stores a dictionary. It should replace any dictionary with the same
+	// Origin, Match and MatchDest.
+	Put(d *Dictionary) error
+	// Match returns the dictionary to advertise for the request, or nil.
+	Match(req *http.Request) *Dictionary
+}
+
+// MemoryDictionaryStore is an in-memory DictionaryStore.
+//
+// When more than one dictionary matches, the one with the longest Match wins,
+// then the most recently fetched, as specified by RFC 9842.
+type MemoryDictionaryStore struct {
+	mu    sync.Mutex
+	dicts []*Dictionary
+}
+
+// Put implements DictionaryStore.
+func (m *MemoryDictionaryStore) Put(d *Dictionary) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dicts = slices.DeleteFunc(m.dicts, func(o *Dictionary) bool {
+		return o.Origin == d.Origin && o.Match == d.Match && slices.Equal(o.MatchDest, d.MatchDest)
+	})
+	m.dicts = append(m.dicts, d)
+	if len(m.dicts) > maxMemoryDictionaries {
+		// Evict the oldest one.
+		m.dicts = m.dicts[1:]
+	}
+	return nil
+}
+
+// Match implements DictionaryStore.
+func (m *MemoryDictionaryStore) Match(req *http.Request) *Dictionary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var best *Dictionary
+	for _, d := range m.dicts {
+		if !d.Matches(req) {
+			continue
+		}
+		if best == nil || len(d.Match) > len(best.Match) || (len(d.Match) == len(best.Match) && !d.Fetched.Before(best.Fetched)) {
+			best = d
+		}
+	}
+	return best
+}
+
+//
+
+// maxMemoryDictionaries is the maximum number of dictionaries kept by
+// MemoryDictionaryStore.
+const maxMemoryDictionaries = 128
+
+// maxDictionarySize is the maximum size of a response body kept as a
+// dictionary. Larger responses are not stored.
+const maxDictionarySize = 16 << 20
+
+// dczMagic is the header of a "dcz" encoded response, followed by the SHA-256
+// of the dictionary.
+var dczMagic = []byte{0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00}
+
+// advertiseDictionary sets the Available-Dictionary and Dictionary-ID headers.
+func advertiseDictionary(req *http.Request, d *Dictionary) {
+	req.Header.Set("Available-Dictionary", ":"+base64.StdEncoding.EncodeToString(d.Hash[:])+":")
+	if d.ID != "" {
+		req.Header.Set("Dictionary-ID", quoteSFString(d.ID))
+	}
+}
+
+// dczDecoder returns a Decoder for "dcz" responses compressed with the
+// dictionary d.
+func dczDecoder(d *Dictionary) Decoder {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		var hdr [40]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("invalid dcz header: %w", err)
+		}
+		if !bytes.Equal(hdr[:8], dczMagic) {
+			return nil, errors.New("invalid dcz header")
+		}
+		if !bytes.Equal(hdr[8:], d.Hash[:]) {
+			return nil, errors.New("dcz response uses an unexpected dictionary")
+		}
+		// RFC 9842 allows a window up to 1.25 times the dictionary size, capped at
+		// 128MiB.
+		window := max(uint64(8<<20), min(uint64(len(d.Content))*5/4, 128<<20))
+		zs, err := zstd.NewReader(r, zstd.WithDecoderMaxWindow(window), zstd.WithDecoderConcurrency(1), zstd.WithDecoderDictRaw(0, d.Content))
+		if err != nil {
+			return nil, err
+		}
+		return zs.IOReadCloser(), nil
+	}
+}
+
+// parseUseAsDictionary parses the Use-As-Dictionary header of a response to a
+// request to u.
+func parseUseAsDictionary(v string, u *url.URL) (*Dictionary, error) {
+	params, err := parseSFDictionary(v)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dictionary{Origin: u.Scheme + "://" + u.Host, Fetched: time.Now()}
+	match := params["match"]
+	if len(match) != 1 || match[0] == "" {
+		return nil, errors.New("Use-As-Dictionary: missing match")
+	}
+	// The match may be relative to the response URL, or absolute on the same
+	// origin.
+	m, err := u.Parse(match[0])
+	if err != nil {
+		return nil, fmt.Errorf("Use-As-Dictionary: invalid match: %w", err)
+	}
+	if m.Scheme+"://"+m.Host != d.Origin {
+		return nil, errors.New("Use-As-Dictionary: match must be same origin")
+	}
+	d.Match = m.Path
+	d.MatchDest = params["match-dest"]
+	if id := params["id"]; len(id) == 1 {
+		d.ID = id[0]
+	}
+	if t := params["type"]; len(t) == 1 && t[0] != "raw" {
+		return nil, fmt.Errorf("Use-As-Dictionary: unsupported type %q", t[0])
+	}
+	return d, nil
+}
+
+// parseSFDictionary parses a subset of a RFC 8941 structured field dictionary
+// sufficient for Use-As-Dictionary: values are strings, tokens or inner lists
+// of strings. Parameters are ignored.
+func parseSFDictionary(v string) (map[string][]string, error) {
+	out := map[string][]string{}
+	for v = strings.TrimSpace(v); v != ""; {
+		i := strings.IndexAny(v, "=,;")
+		if i == -1 {
+			i = len(v)
+		}
+		key := strings.TrimSpace(v[:i])
+		if key == "" {
+			return nil, fmt.Errorf("invalid structured field %q", v)
+		}
+		v = v[i:]
+		var values []string
+		if strings.HasPrefix(v, "=") {
+			v = strings.TrimLeft(v[1:], " ")
+			if strings.HasPrefix(v, "(") {
+				v = v[1:]
+				for {
+					if v = strings.TrimLeft(v, " "); strings.HasPrefix(v, ")") {
+						v = v[1:]
+						break
+					}
+					var item string
+					var err error
+					if item, v, err = parseSFItem(v); err != nil {
+						return nil, err
+					}
+					values = append(values, item)
+				}
+			} else {
+				var item string
+				var err error
+				if item, v, err = parseSFItem(v); err != nil {
+					return nil, err
+				}
+				values = []string{item}
+			}
+		} else {
+			// Boolean true.
+			values = []string{"?1"}
+		}
+		// Skip parameters.
+		if i := strings.IndexByte(v, ','); i != -1 {
+			v = strings.TrimSpace(v[i+1:])
+		} else {
+			v = ""
+		}
+		out[key] = values
+	}
+	return out, nil
+}
+
+// parseSFItem parses a string or a token and returns the remainder.
+func parseSFItem(v string) (string, string, error) {
+	if !strings.HasPrefix(v, "\"") {
+		i := strings.IndexAny(v, " ,;)")
+		if i == -1 {
+			i = len(v)
+		}
+		if i == 0 {
+			return "", "", fmt.Errorf("invalid structured field item %q", v)
+		}
+		return v[:i], v[i:], nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(v); i++ {
+		switch c := v[i]; c {
+		case '\\':
+			if i++; i == len(v) {
+				return "", "", errors.New("invalid structured field string")
+			}
+			b.WriteByte(v[i])
+		case '"':
+			return b.String(), v[i+1:], nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", errors.New("unterminated structured field string")
+}
+
+// quoteSFString returns s as a RFC 8941 structured field string.
+func quoteSFString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// matchPattern matches s against a pattern where "*" matches any sequence of
+// characters.
+func matchPattern(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, p)
+		if i == -1 {
+			return false
+		}
+		s = s[i+len(p):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// dictionaryBody stores the response body as a dictionary once fully read.
+type dictionaryBody struct {
+	body     io.ReadCloser
+	d        *Dictionary
+	store    DictionaryStore
+	content  bytes.Buffer
+	overflow bool
+}
+
+func (d *dictionaryBody) Read(p []byte) (int, error) {
+	n, err := d.body.Read(p)
+	if !d.overflow {
+		if d.content.Len()+n > maxDictionarySize {
+			d.overflow = true
+			d.content = bytes.Buffer{}
+		} else {
+			_, _ = d.content.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !d.overflow && d.d != nil {
+		d.d.Content = d.content.Bytes()
+		d.d.Hash = sha256.Sum256(d.d.Content)
+		_ = d.store.Put(d.d)
+		d.d = nil
+	}
+	return n, err
+}
+
+func (d *dictionaryBody) Close() error {
+	return d.body.Close()
+}
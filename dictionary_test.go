@@ -0,0 +1,133 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestAcceptCompressed_Dictionaries(t *testing.T) {
+	dict := []byte(strings.Repeat(`{"name":"value","other":"thing"}`, 10))
+	hash := sha256.Sum256(dict)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dict" {
+			w.Header().Set("Use-As-Dictionary", `match="/api/*", match-dest=(), id="v1"`)
+			_, _ = w.Write(dict)
+			return
+		}
+		if ad := r.Header.Get("Available-Dictionary"); ad != ":"+base64.StdEncoding.EncodeToString(hash[:])+":" {
+			_, _ = w.Write([]byte("no dictionary"))
+			return
+		}
+		if id := r.Header.Get("Dictionary-ID"); id != `"v1"` {
+			http.Error(w, "unexpected Dictionary-ID "+id, http.StatusBadRequest)
+			return
+		}
+		if ae := r.Header.Get("Accept-Encoding"); ae != "dcz, zstd, br, gzip" {
+			http.Error(w, "unexpected Accept-Encoding "+ae, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Encoding", "dcz")
+		_, _ = w.Write(dczMagic)
+		_, _ = w.Write(hash[:])
+		zs, err := zstd.NewWriter(w, zstd.WithEncoderDictRaw(0, dict))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = zs.Write([]byte(`{"name":"value","other":"thing"}`))
+		_ = zs.Close()
+	}))
+	defer ts.Close()
+
+	c := http.Client{Transport: &AcceptCompressed{Transport: http.DefaultTransport, Dictionaries: &MemoryDictionaryStore{}}}
+	get := func(path string) string {
+		resp, err := c.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatal(resp.StatusCode, string(b))
+		}
+		return string(b)
+	}
+	if s := get("/api/1"); s != "no dictionary" {
+		t.Fatal(s)
+	}
+	if s := get("/dict"); s != string(dict) {
+		t.Fatal(s)
+	}
+	if s := get("/api/1"); s != `{"name":"value","other":"thing"}` {
+		t.Fatal(s)
+	}
+	if s := get("/other"); s != "no dictionary" {
+		t.Fatal(s)
+	}
+}
+
+func TestParseUseAsDictionary(t *testing.T) {
+	u, _ := url.Parse("https://example.com/a/b")
+	data := []struct {
+		in        string
+		match     string
+		matchDest []string
+		id        string
+	}{
+		{`match="/app/*"`, "/app/*", nil, ""},
+		{`match="*.js", id="x \"1\""`, "/a/*.js", nil, `x "1"`},
+		{`match="/*", match-dest=("document" "frame"), type=raw`, "/*", []string{"document", "frame"}, ""},
+		{`match="https://example.com/p"`, "/p", nil, ""},
+	}
+	for _, line := range data {
+		d, err := parseUseAsDictionary(line.in, u)
+		if err != nil {
+			t.Fatal(line.in, err)
+		}
+		if d.Match != line.match || !slices.Equal(d.MatchDest, line.matchDest) || d.ID != line.id || d.Origin != "https://example.com" {
+			t.Fatalf("%s: %#v", line.in, d)
+		}
+	}
+	for _, in := range []string{`id="x"`, `match="https://other.com/*"`, `match="/*", type=other`, `match="/*`} {
+		if _, err := parseUseAsDictionary(in, u); err == nil {
+			t.Fatal(in)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	data := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"/a", "/a", true},
+		{"/a", "/b", false},
+		{"/a/*", "/a/b/c", true},
+		{"/a/*", "/b/a/", false},
+		{"/*.js", "/x/y.js", true},
+		{"/*.js", "/x/y.css", false},
+		{"/a/*/c*", "/a/b/cd", true},
+	}
+	for _, line := range data {
+		if got := matchPattern(line.pattern, line.s); got != line.want {
+			t.Errorf("matchPattern(%q, %q) = %t", line.pattern, line.s, got)
+		}
+	}
+}
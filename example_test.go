@@ -25,20 +25,12 @@ import (
 )
 
 func Example_gET() {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Check Accept-Encoding first!
-		w.Header().Set("Content-Encoding", "zstd")
-		c, err := zstd.NewWriter(w)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		_, _ = c.Write([]byte("Awesome"))
-		if err = c.Close(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}))
+	// CompressedHandler compresses the response according to Accept-Encoding.
+	ts := httptest.NewServer(&roundtrippers.CompressedHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("Awesome"))
+		}),
+	})
 	defer ts.Close()
 
 	// Make all HTTP request in the current program:
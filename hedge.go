@@ -0,0 +1,195 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Hedge sends additional copies of a slow request and returns the first
+// response received. The other copies are canceled.
+//
+// It trades extra load on the server for lower tail latency. Only requests with
+// an idempotent method, e.g. GET, are hedged; the others are sent as is.
+//
+// A copy is only sent when the delay expires. When a copy fails, the error is
+// returned once no other copy is in flight; use Retry to retry.
+//
+// See https://research.google/pubs/the-tail-at-scale/
+type Hedge struct {
+	Transport http.RoundTripper
+	// Delay is the time to wait for a response before sending the next copy.
+	// Defaults to 100ms.
+	Delay time.Duration
+	// Percentile optionally sets the delay to this percentile of the observed
+	// latencies, e.g. 0.95. Delay is used until enough latencies are recorded.
+	//
+	// The latency of a copy is measured from the time it is sent.
+	Percentile float64
+	// MaxCopies is the maximum number of copies of a request in flight,
+	// including the original one. Defaults to 2.
+	MaxCopies int
+	// TimeAfter can be hooked for unit tests to disable sleeping. It defaults to time.After().
+	TimeAfter func(d time.Duration) <-chan time.Time
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+// RoundTrip implements http.RoundTripper.
+func (h *Hedge) RoundTrip(req *http.Request) (*http.Response, error) {
+	maxCopies := h.MaxCopies
+	if maxCopies <= 0 {
+		maxCopies = 2
+	}
+	if maxCopies == 1 || !isIdempotent(req.Method) {
+		return h.Transport.RoundTrip(req)
+	}
+	var err error
+	if req, err = cloneRequestWithBody(req); err != nil {
+		return nil, err
+	}
+	timeAfter := h.TimeAfter
+	if timeAfter == nil {
+		timeAfter = time.After
+	}
+	results := make(chan hedgeResult, maxCopies)
+	var cancels []context.CancelCauseFunc
+	var starts []time.Time
+	send := func() error {
+		ctx, cancel := context.WithCancelCause(req.Context())
+		req2 := req.Clone(ctx)
+		if req.GetBody != nil {
+			var err2 error
+			if req2.Body, err2 = req.GetBody(); err2 != nil {
+				cancel(nil)
+				return err2
+			}
+		}
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		starts = append(starts, time.Now())
+		go func() {
+			resp, err2 := h.Transport.RoundTrip(req2)
+			results <- hedgeResult{resp: resp, err: err2, i: i}
+		}()
+		return nil
+	}
+	if err = send(); err != nil {
+		return nil, err
+	}
+	inflight := 1
+	timer := timeAfter(h.delay())
+	for {
+		select {
+		case res := <-results:
+			inflight--
+			if res.err == nil {
+				h.record(time.Since(starts[res.i]))
+				for i, cancel := range cancels {
+					if i != res.i {
+						cancel(errHedgeLost)
+					}
+				}
+				go drainHedges(results, inflight)
+				res.resp.Body = &cancelBody{ReadCloser: res.resp.Body, cancel: cancels[res.i]}
+				return res.resp, nil
+			}
+			cancels[res.i](nil)
+			err = res.err
+			if inflight == 0 {
+				return nil, err
+			}
+		case <-timer:
+			timer = nil
+			if len(cancels) < maxCopies {
+				if err = send(); err != nil {
+					continue
+				}
+				inflight++
+				if len(cancels) < maxCopies {
+					timer = timeAfter(h.delay())
+				}
+			}
+		}
+	}
+}
+
+// Unwrap implements Unwrapper.
+func (h *Hedge) Unwrap() http.RoundTripper {
+	return h.Transport
+}
+
+//
+
+type hedgeResult struct {
+	resp *http.Response
+	err  error
+	i    int
+}
+
+// hedgeSamples is the number of latencies kept to calculate the percentile.
+const hedgeSamples = 100
+
+// hedgeMinSamples is the number of latencies needed before using the
+// percentile.
+const hedgeMinSamples = 10
+
+// errHedgeLost is the cancellation cause of the copies that lost the race.
+var errHedgeLost = errors.New("roundtrippers.Hedge: another copy of the request won")
+
+// delay returns the time to wait before sending the next copy.
+func (h *Hedge) delay() time.Duration {
+	d := h.Delay
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	if h.Percentile <= 0 {
+		return d
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.latencies) < hedgeMinSamples {
+		return d
+	}
+	sorted := slices.Clone(h.latencies)
+	slices.Sort(sorted)
+	i := int(h.Percentile * float64(len(sorted)))
+	return sorted[min(i, len(sorted)-1)]
+}
+
+// record records the latency of a successful copy, measured from its own send
+// time. Measuring from the first send would shorten the samples as soon as
+// hedging kicks in, lowering the delay further.
+func (h *Hedge) record(d time.Duration) {
+	if h.Percentile <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.latencies) < hedgeSamples {
+		h.latencies = append(h.latencies, d)
+		return
+	}
+	h.latencies[h.next] = d
+	h.next = (h.next + 1) % hedgeSamples
+}
+
+// drainHedges closes the responses of the copies that lost the race.
+func drainHedges(results <-chan hedgeResult, inflight int) {
+	for range inflight {
+		if res := <-results; res.resp != nil {
+			_, _ = io.Copy(io.Discard, res.resp.Body)
+			_ = res.resp.Body.Close()
+		}
+	}
+}
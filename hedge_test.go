@@ -0,0 +1,188 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedge(t *testing.T) {
+	var count atomic.Int64
+	var canceled atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b, _ := io.ReadAll(r.Body); string(b) != "" {
+			t.Errorf("unexpected body %q", b)
+		}
+		if count.Add(1) == 1 {
+			// The first copy hangs until it is canceled.
+			<-r.Context().Done()
+			canceled.Add(1)
+			return
+		}
+		_, _ = w.Write([]byte("hi"))
+	}))
+	defer ts.Close()
+	c := http.Client{Transport: &Hedge{Transport: http.DefaultTransport, Delay: 10 * time.Millisecond}}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "hi" {
+		t.Fatalf("want \"hi\", got %q", s)
+	}
+	if v := count.Load(); v != 2 {
+		t.Fatalf("expected 2 copies, got %d", v)
+	}
+	for i := 0; canceled.Load() != 1; i++ {
+		if i == 100 {
+			t.Fatal("the losing copy was not canceled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHedge_body(t *testing.T) {
+	var count atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if count.Add(1) == 1 {
+			<-r.Context().Done()
+			return
+		}
+		_, _ = w.Write(b)
+	}))
+	defer ts.Close()
+	c := http.Client{Transport: &Hedge{Transport: http.DefaultTransport, Delay: 10 * time.Millisecond}}
+	req, err := http.NewRequestWithContext(t.Context(), "PUT", ts.URL, &reader{"hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if s := string(b); s != "hello" {
+		t.Fatalf("want \"hello\", got %q", s)
+	}
+}
+
+func TestHedge_not_idempotent(t *testing.T) {
+	var count atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer ts.Close()
+	c := http.Client{Transport: &Hedge{Transport: http.DefaultTransport, Delay: time.Millisecond}}
+	resp, err := c.Post(ts.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if v := count.Load(); v != 1 {
+		t.Fatalf("expected 1 copy, got %d", v)
+	}
+}
+
+func TestHedge_error(t *testing.T) {
+	var count atomic.Int64
+	errFail := errors.New("fail")
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		count.Add(1)
+		return nil, errFail
+	})
+	c := http.Client{Transport: &Hedge{Transport: rt, Delay: time.Hour, MaxCopies: 3}}
+	if _, err := c.Get("http://localhost"); !errors.Is(err, errFail) {
+		t.Fatal(err)
+	}
+	// A failure is not retried.
+	if v := count.Load(); v != 1 {
+		t.Fatalf("expected 1 copy, got %d", v)
+	}
+}
+
+func TestHedge_latency(t *testing.T) {
+	var count atomic.Int64
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if count.Add(1) == 1 {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("hi"))}, nil
+	})
+	h := &Hedge{Transport: rt, Delay: 50 * time.Millisecond, Percentile: 0.9}
+	req, err := http.NewRequestWithContext(t.Context(), "GET", "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	// The latency of the winning copy is measured from its own send, not from
+	// the first one.
+	if len(h.latencies) != 1 || h.latencies[0] >= 50*time.Millisecond {
+		t.Fatal(h.latencies)
+	}
+}
+
+func TestHedge_default(t *testing.T) {
+	h := Hedge{}
+	if d := h.delay(); d != 100*time.Millisecond {
+		t.Fatal(d)
+	}
+}
+
+func TestHedge_Percentile(t *testing.T) {
+	h := Hedge{Delay: time.Second, Percentile: 0.9}
+	for i := range 9 {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	if d := h.delay(); d != time.Second {
+		t.Fatal(d)
+	}
+	h.record(9 * time.Millisecond)
+	if d := h.delay(); d != 9*time.Millisecond {
+		t.Fatal(d)
+	}
+	for range 200 {
+		h.record(time.Millisecond)
+	}
+	if d := h.delay(); d != time.Millisecond || len(h.latencies) != hedgeSamples {
+		t.Fatal(d, len(h.latencies))
+	}
+}
+
+func TestHedge_Unwrap(t *testing.T) {
+	var r http.RoundTripper = &Hedge{Transport: http.DefaultTransport}
+	if r.(Unwrapper).Unwrap() != http.DefaultTransport {
+		t.Fatal("unexpected")
+	}
+}
+
+//
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -17,6 +17,8 @@ import (
 // Log is a http.RoundTripper that logs each request and response via slog.
 // It defaults to slog.LevelInfo level unless an error is returned from the
 // roundtripper, then the final log is logged at error level.
+//
+// When wrapped by Retry, each try is logged with its attempt number.
 type Log struct {
 	Transport           http.RoundTripper
 	Logger              *slog.Logger
@@ -34,6 +36,9 @@ func (l *Log) RoundTrip(req *http.Request) (*http.Response, error) {
 		return nil, errors.New("roundtrippers.Log requires roundtrippers.RequestID")
 	}
 	ll := l.Logger.With("id", rid, "dur", elapsedTimeValue{start: time.Now()})
+	if attempt := RetryAttempt(ctx); attempt != 0 {
+		ll = ll.With("attempt", attempt)
+	}
 	ll.Log(ctx, l.Level, "http", "url", req.URL.String(), "method", req.Method, "Content-Encoding", req.Header.Get("Content-Encoding"))
 	resp, err := l.Transport.RoundTrip(req)
 	if err != nil {
@@ -5,30 +5,174 @@
 package roundtrippers
 
 import (
+	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/dict"
 	"github.com/klauspost/compress/zstd"
 )
 
-// PostCompressed empowers the client to POST zstd, br and gzip compressed requests.
+// PostCompressed empowers the client to POST zstd, br, gzip and deflate compressed requests.
 type PostCompressed struct {
 	Transport http.RoundTripper
-	// Encoding determines HTTP POST compression. It must be empty or one of: "zstd", "br" or "zstd".
+	// Encoding determines HTTP POST compression. It must be one of: "br", "deflate", "gzip" or "zstd".
 	//
 	// Warning ⚠: compressing POST content is not supported on most servers.
 	Encoding string
-	// Level is the compression level.
+	// Level is the compression level. See CompressionLevels for the valid
+	// values and defaults.
 	// - "br" uses values between 1 and 11. If unset, defaults to 3.
+	// - "deflate" uses values between 1 and 9. If unset, defaults to 3.
 	// - "gzip" uses values between 1 and 9. If unset, defaults to 3.
-	// - "zstd"  uses values between 1 and 4. If unset, defaults to 2.
+	// - "zstd"  uses values between 1 and 4. If unset, defaults to 1.
 	Level int
+	// MinSize is the minimum body size in bytes to compress. Smaller bodies are
+	// sent unchanged. Bodies of unknown size are always compressed.
+	MinSize int64
+	// ContentTypes restricts compression to these media types. A trailing "/*"
+	// matches all subtypes, e.g. "text/*". If empty, all media types are
+	// compressed except the ones in SkipContentTypes.
+	ContentTypes []string
+	// SkipContentTypes lists media types that are never compressed, generally
+	// because they are already compressed. A trailing "/*" matches all subtypes.
+	//
+	// If nil, defaults to DefaultSkipContentTypes. Set to an empty slice to
+	// disable.
+	SkipContentTypes []string
+	// Fallback replays the request uncompressed when the server replies with one
+	// of FallbackStatusCodes, and skips compression for this host for
+	// FallbackTTL.
+	Fallback bool
+	// FallbackStatusCodes are the HTTP status codes meaning the server doesn't
+	// support compressed requests.
+	//
+	// If unset, defaults to 415 (Unsupported Media Type) as specified in RFC 7694.
+	FallbackStatusCodes []int
+	// FallbackTTL is how long a host is remembered as not supporting compressed
+	// requests.
+	//
+	// If unset, defaults to one hour.
+	FallbackTTL time.Duration
+	// Dictionary is a zstd dictionary to compress with when Encoding is "zstd".
+	// It is either a dictionary in the zstd format, e.g. as returned by
+	// TrainZstdDictionary, which embeds its ID, or raw content used along
+	// DictionaryID.
+	//
+	// The server must know the dictionary to decompress the request. Its
+	// encoders are pooled by this PostCompressed; assign a new slice to change
+	// the dictionary instead of modifying it in place.
+	Dictionary []byte
+	// DictionaryID is the ID of a raw Dictionary and must not be 0. It is
+	// ignored for zstd format dictionaries.
+	DictionaryID uint32
+	// DictionaryHeader is the request header set to the dictionary ID when
+	// Dictionary is used.
+	//
+	// If unset, defaults to "X-Zstd-Dictionary-ID".
+	DictionaryHeader string
+	// Stats, when set, accumulates the uncompressed and compressed sizes of
+	// request bodies.
+	Stats *CompressionStats
+
+	// state is behind a pointer so PostCompressed can be copied by value.
+	state *postCompressedState
+}
+
+// postCompressedState is the mutable state of a PostCompressed.
+type postCompressedState struct {
+	mu          sync.Mutex
+	unsupported map[string]time.Time
+	dictPool    *dictEncoderPool
+}
+
+// NewPostCompressed returns a PostCompressed after validating the encoding and
+// the compression level.
+//
+// It returns an *InvalidEncodingError or an *InvalidLevelError, so
+// configuration can be checked at startup instead of at the first request.
+func NewPostCompressed(t http.RoundTripper, encoding string, level int) (*PostCompressed, error) {
+	p := &PostCompressed{Transport: t, Encoding: encoding, Level: level}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// CompressionLevel is the range of valid compression levels for an encoding.
+type CompressionLevel struct {
+	Min     int
+	Max     int
+	Default int
+}
+
+// CompressionLevels lists the encodings supported by PostCompressed and their
+// valid compression levels.
+var CompressionLevels = map[string]CompressionLevel{
+	"br":      {Min: 1, Max: 11, Default: 3},
+	"deflate": {Min: 1, Max: 9, Default: 3},
+	"gzip":    {Min: 1, Max: 9, Default: 3},
+	"zstd":    {Min: int(zstd.SpeedFastest), Max: int(zstd.SpeedBestCompression), Default: int(zstd.SpeedFastest)},
+}
+
+// InvalidEncodingError is returned by PostCompressed when Encoding is not
+// supported.
+type InvalidEncodingError struct {
+	Encoding string
+}
+
+func (i *InvalidEncodingError) Error() string {
+	if i.Encoding == "" {
+		return "do not use PostCompressed without Encoding"
+	}
+	return fmt.Sprintf("invalid Encoding value: %q", i.Encoding)
+}
+
+// InvalidLevelError is returned by PostCompressed when Level is out of range
+// for the Encoding.
+type InvalidLevelError struct {
+	Encoding string
+	Level    int
+	Min      int
+	Max      int
+}
 
-	_ struct{}
+func (i *InvalidLevelError) Error() string {
+	return fmt.Sprintf("invalid Level %d for Encoding %q: must be between %d and %d", i.Level, i.Encoding, i.Min, i.Max)
+}
+
+// DefaultSkipContentTypes are media types that are already compressed and do
+// not benefit from being compressed again.
+var DefaultSkipContentTypes = []string{
+	"application/gzip",
+	"application/vnd.rar",
+	"application/x-7z-compressed",
+	"application/x-bzip2",
+	"application/x-gzip",
+	"application/x-xz",
+	"application/zip",
+	"application/zstd",
+	"audio/*",
+	"font/woff",
+	"font/woff2",
+	"image/avif",
+	"image/gif",
+	"image/heic",
+	"image/jpeg",
+	"image/png",
+	"image/webp",
+	"video/*",
 }
 
 // RoundTrip implements http.RoundTripper.
@@ -37,24 +181,75 @@ func (p *PostCompressed) RoundTrip(req *http.Request) (*http.Response, error) {
 		// Nothing to compress or it is already encoded.
 		return p.Transport.RoundTrip(req)
 	}
+	if !p.compressible(req.Header.Get("Content-Type")) || (p.Fallback && p.isUnsupported(req.URL.Host)) {
+		return p.Transport.RoundTrip(req)
+	}
+	// cloneRequestWithBody buffers the body in memory when GetBody is unset.
+	buffered := req.GetBody == nil
 	var err error
 	if req, err = cloneRequestWithBody(req); err != nil {
 		return nil, err
 	}
-	oldGetBody := req.GetBody
-	if req.Body, err = p.getCompressedBody(req.Body); err != nil {
-		return nil, err
+	if req.ContentLength > 0 && req.ContentLength < p.MinSize {
+		return p.Transport.RoundTrip(req)
 	}
-	req.GetBody = func() (io.ReadCloser, error) {
-		b2, err2 := oldGetBody()
+	creq := req.Clone(req.Context())
+	// compressedSize is the size of the body compressed in memory, -1 when
+	// streamed.
+	compressedSize := int64(-1)
+	if req.ContentLength > 0 && (buffered || req.ContentLength <= maxSyncCompressSize) {
+		// The body is in memory or small, compress synchronously so
+		// Content-Length can be set and the compressed bytes reused on redirects
+		// and retries. Large bodies provided by the caller are streamed to not
+		// hold them in memory.
+		compressed, err2 := p.getCompressedBytes(req.Body, req.ContentLength)
 		if err2 != nil {
-			return b2, err2
+			return nil, err2
+		}
+		creq.Body = io.NopCloser(bytes.NewReader(compressed))
+		creq.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(compressed)), nil
+		}
+		compressedSize = int64(len(compressed))
+		creq.ContentLength = compressedSize
+	} else {
+		if creq.Body, err = p.getCompressedBody(req.Body, req.URL.Host); err != nil {
+			return nil, err
+		}
+		creq.GetBody = func() (io.ReadCloser, error) {
+			b2, err2 := req.GetBody()
+			if err2 != nil {
+				return b2, err2
+			}
+			return p.getCompressedBody(b2, req.URL.Host)
+		}
+		creq.ContentLength = -1
+	}
+	creq.Header.Del("Content-Length")
+	creq.Header.Set("Content-Encoding", p.Encoding)
+	if len(p.Dictionary) != 0 {
+		h := p.DictionaryHeader
+		if h == "" {
+			h = "X-Zstd-Dictionary-ID"
 		}
-		return p.getCompressedBody(b2)
+		creq.Header.Set(h, strconv.FormatUint(uint64(p.dictionaryID()), 10))
+	}
+	resp, err := p.Transport.RoundTrip(creq)
+	if resp == nil || !p.Fallback || !p.isFallbackStatus(resp.StatusCode) {
+		if err == nil && p.Stats != nil && compressedSize >= 0 {
+			// Streamed bodies are recorded by getCompressedBody.
+			p.Stats.Add(CompressionStatsKey{Sent: true, Encoding: p.Encoding, Host: req.URL.Host}, compressedSize, req.ContentLength)
+		}
+		return resp, err
+	}
+	// The server doesn't support compressed requests. Remember it and replay
+	// uncompressed.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	p.markUnsupported(req.URL.Host)
+	if req.Body, err = req.GetBody(); err != nil {
+		return nil, err
 	}
-	req.ContentLength = -1
-	req.Header.Del("Content-Length")
-	req.Header.Set("Content-Encoding", p.Encoding)
 	return p.Transport.RoundTrip(req)
 }
 
@@ -62,87 +257,332 @@ func (p *PostCompressed) Unwrap() http.RoundTripper {
 	return p.Transport
 }
 
-func (p *PostCompressed) getCompressedBody(oldBody io.ReadCloser) (io.ReadCloser, error) {
+func (p *PostCompressed) isFallbackStatus(code int) bool {
+	if p.FallbackStatusCodes == nil {
+		return code == http.StatusUnsupportedMediaType
+	}
+	return slices.Contains(p.FallbackStatusCodes, code)
+}
+
+// isUnsupported returns true if the host was recently found to not support
+// compressed requests.
+func (p *PostCompressed) isUnsupported(host string) bool {
+	st := p.getState()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	expiration, ok := st.unsupported[host]
+	if ok && time.Now().After(expiration) {
+		delete(st.unsupported, host)
+		return false
+	}
+	return ok
+}
+
+func (p *PostCompressed) markUnsupported(host string) {
+	ttl := p.FallbackTTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	st := p.getState()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.unsupported == nil {
+		st.unsupported = map[string]time.Time{}
+	}
+	st.unsupported[host] = time.Now().Add(ttl)
+}
+
+// getState returns the mutable state, creating it on first use. Copies made
+// after the first use share it.
+func (p *PostCompressed) getState() *postCompressedState {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if p.state == nil {
+		p.state = &postCompressedState{}
+	}
+	return p.state
+}
+
+// stateMu protects the lazy initialization of PostCompressed.state.
+var stateMu sync.Mutex
+
+// compressible returns true if a body with this Content-Type should be
+// compressed.
+func (p *PostCompressed) compressible(contentType string) bool {
+	mt, _, _ := strings.Cut(contentType, ";")
+	mt = strings.ToLower(strings.TrimSpace(mt))
+	if len(p.ContentTypes) != 0 && !matchMediaType(p.ContentTypes, mt) {
+		return false
+	}
+	skip := p.SkipContentTypes
+	if skip == nil {
+		skip = DefaultSkipContentTypes
+	}
+	return !matchMediaType(skip, mt)
+}
+
+// maxSyncCompressSize is the largest body with a caller provided GetBody that
+// is compressed in memory.
+const maxSyncCompressSize = 1 << 20
+
+// getCompressedBody compresses the body in a goroutine through a pipe. It is
+// used for bodies of unknown size or too large to be held in memory.
+func (p *PostCompressed) getCompressedBody(oldBody io.ReadCloser, host string) (io.ReadCloser, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
 	r, w := io.Pipe()
-	switch p.Encoding {
-	case "gzip":
-		go func() {
-			l := p.Level
-			if l == 0 {
-				// Use a fast compression level.
-				l = 3
-			}
-			gz, err := gzip.NewWriterLevel(w, l)
-			if err != nil {
-				_ = oldBody.Close()
-				_ = w.CloseWithError(err)
-				return
-			}
-			_, err = io.Copy(gz, oldBody)
-			if err2 := oldBody.Close(); err == nil {
-				err = err2
-			}
-			if err2 := gz.Close(); err == nil {
-				err = err2
-			}
-			if err != nil {
-				_ = w.CloseWithError(err)
-				return
-			}
-			_ = w.Close()
-		}()
-		return r, nil
+	go func() {
+		src := &countingReader{r: oldBody}
+		dst := &countingWriter{w: w}
+		err := p.compress(dst, src, -1)
+		if err2 := oldBody.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			_ = w.CloseWithError(err)
+			return
+		}
+		if p.Stats != nil {
+			p.Stats.Add(CompressionStatsKey{Sent: true, Encoding: p.Encoding, Host: host}, dst.n, src.n)
+		}
+		_ = w.Close()
+	}()
+	return r, nil
+}
+
+// getCompressedBytes compresses the body synchronously.
+func (p *PostCompressed) getCompressedBytes(oldBody io.ReadCloser, size int64) ([]byte, error) {
+	if err := p.validate(); err != nil {
+		_ = oldBody.Close()
+		return nil, err
+	}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer bufferPool.Put(buf)
+	buf.Reset()
+	err := p.compress(buf, oldBody, size)
+	if err2 := oldBody.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+func (p *PostCompressed) validate() error {
+	cl, ok := CompressionLevels[p.Encoding]
+	if !ok {
+		return &InvalidEncodingError{Encoding: p.Encoding}
+	}
+	if p.Level != 0 && (p.Level < cl.Min || p.Level > cl.Max) {
+		return &InvalidLevelError{Encoding: p.Encoding, Level: p.Level, Min: cl.Min, Max: cl.Max}
+	}
+	if len(p.Dictionary) != 0 {
+		if p.Encoding != "zstd" {
+			return fmt.Errorf("Dictionary is not supported with Encoding %q", p.Encoding)
+		}
+		if p.dictionaryID() == 0 {
+			// The frames would not carry a dictionary ID, so the server couldn't
+			// tell which dictionary to use.
+			return errors.New("raw Dictionary requires a non-zero DictionaryID")
+		}
+	}
+	return nil
+}
+
+// compress compresses src into dst with a pooled encoder. size is the size of
+// src if known, -1 otherwise.
+func (p *PostCompressed) compress(dst io.Writer, src io.Reader, size int64) error {
+	k := encoderKey{encoding: p.Encoding, level: p.Level}
+	var pool *dictEncoderPool
+	var e encoder
+	var err error
+	if len(p.Dictionary) != 0 {
+		pool = p.dictEncoderPool()
+		e, err = pool.get()
+	} else {
+		e, err = getEncoder(k)
+	}
+	if err != nil {
+		return err
+	}
+	if zs, ok := e.(*zstd.Encoder); ok {
+		// Record the size in the frame header when known, so the server can
+		// preallocate.
+		zs.ResetContentSize(dst, size)
+	} else {
+		e.Reset(dst)
+	}
+	_, err = io.Copy(e, src)
+	if err2 := e.Close(); err == nil {
+		err = err2
+	}
+	if pool != nil {
+		pool.pool.Put(e)
+	} else {
+		putEncoder(k, e)
+	}
+	return err
+}
+
+// dictEncoderPool returns the pool of encoders for the current Dictionary.
+//
+// Encoders with a dictionary are pooled per PostCompressed instead of globally
+// so they, and the dictionary, are released along the PostCompressed.
+func (p *PostCompressed) dictEncoderPool() *dictEncoderPool {
+	level := p.Level
+	if level == 0 {
+		level = CompressionLevels[p.Encoding].Default
+	}
+	st := p.getState()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if d := st.dictPool; d == nil || d.level != level || d.id != p.DictionaryID || len(d.dict) != len(p.Dictionary) || &d.dict[0] != &p.Dictionary[0] {
+		st.dictPool = &dictEncoderPool{level: level, id: p.DictionaryID, dict: p.Dictionary}
+	}
+	return st.dictPool
+}
+
+// dictionaryID returns the ID of the zstd dictionary.
+func (p *PostCompressed) dictionaryID() uint32 {
+	if id, ok := zstdDictionaryID(p.Dictionary); ok {
+		return id
+	}
+	return p.DictionaryID
+}
+
+// Encoders without a dictionary are pooled per encoding and level.
+
+// encoder is implemented by all the compressors.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+type encoderKey struct {
+	encoding string
+	level    int
+}
+
+// getEncoder returns a pooled encoder. Reset must be called before use and
+// the encoder returned with putEncoder after Close.
+func getEncoder(k encoderKey) (encoder, error) {
+	if k.level == 0 {
+		// Use a fast compression level.
+		k.level = CompressionLevels[k.encoding].Default
+	}
+	pool, _ := encoderPools.LoadOrStore(k, &sync.Pool{})
+	if e, _ := pool.(*sync.Pool).Get().(encoder); e != nil {
+		return e, nil
+	}
+	return newEncoder(k.encoding, k.level, nil, 0)
+}
+
+// newEncoder returns a new encoder. dictionary is only supported with "zstd";
+// id is the ID of a raw dictionary.
+func newEncoder(encoding string, level int, dictionary []byte, id uint32) (encoder, error) {
+	switch encoding {
 	case "br":
-		go func() {
-			l := p.Level
-			if l == 0 {
-				// Use a fast compression level.
-				l = 3
-			}
-			br := brotli.NewWriterLevel(w, l)
-			_, err := io.Copy(br, oldBody)
-			if err2 := oldBody.Close(); err == nil {
-				err = err2
-			}
-			if err2 := br.Close(); err == nil {
-				err = err2
-			}
-			if err != nil {
-				_ = w.CloseWithError(err)
-				return
-			}
-			_ = w.Close()
-		}()
-		return r, nil
+		return brotli.NewWriterLevel(nil, level), nil
+	case "deflate":
+		// The HTTP "deflate" content coding is the zlib format.
+		return zlib.NewWriterLevel(nil, level)
+	case "gzip":
+		return gzip.NewWriterLevel(nil, level)
 	case "zstd":
-		go func() {
-			l := zstd.EncoderLevel(p.Level)
-			if l == 0 {
-				// Use a fast compression level.
-				l = zstd.SpeedFastest
+		// A concurrency of 1 encodes synchronously without starting goroutines,
+		// which makes the encoder safe to keep in a sync.Pool.
+		opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevel(level)), zstd.WithEncoderConcurrency(1)}
+		if len(dictionary) != 0 {
+			if _, ok := zstdDictionaryID(dictionary); ok {
+				opts = append(opts, zstd.WithEncoderDict(dictionary))
+			} else {
+				opts = append(opts, zstd.WithEncoderDictRaw(id, dictionary))
 			}
-			zs, err := zstd.NewWriter(w, zstd.WithEncoderLevel(l))
-			if err != nil {
-				_ = oldBody.Close()
-				_ = w.CloseWithError(err)
-				return
-			}
-			_, err = io.Copy(zs, oldBody)
-			if err2 := oldBody.Close(); err == nil {
-				err = err2
-			}
-			if err2 := zs.Close(); err == nil {
-				err = err2
-			}
-			if err != nil {
-				_ = w.CloseWithError(err)
-				return
-			}
-			_ = w.Close()
-		}()
-		return r, nil
-	case "":
-		return nil, errors.New("do not use PostCompressed without Encoding")
+		}
+		return zstd.NewWriter(nil, opts...)
+	}
+	return nil, &InvalidEncodingError{Encoding: encoding}
+}
+
+func putEncoder(k encoderKey, e encoder) {
+	if k.level == 0 {
+		k.level = CompressionLevels[k.encoding].Default
+	}
+	if pool, ok := encoderPools.Load(k); ok {
+		pool.(*sync.Pool).Put(e)
+	}
+}
+
+// dictEncoderPool pools the zstd encoders of a dictionary.
+type dictEncoderPool struct {
+	level int
+	id    uint32
+	dict  []byte
+	pool  sync.Pool
+}
+
+func (d *dictEncoderPool) get() (encoder, error) {
+	if e, _ := d.pool.Get().(encoder); e != nil {
+		return e, nil
+	}
+	return newEncoder("zstd", d.level, d.dict, d.id)
+}
+
+var (
+	encoderPools sync.Map
+	bufferPool   = sync.Pool{New: func() any { return &bytes.Buffer{} }}
+)
+
+// matchMediaType returns true if mt matches one of the patterns.
+func matchMediaType(patterns []string, mt string) bool {
+	for _, p := range patterns {
+		if p = strings.ToLower(p); p == mt || (strings.HasSuffix(p, "/*") && strings.HasPrefix(mt, p[:len(p)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// zstdDictionaryID returns the ID of a zstd format dictionary. It returns
+// false for raw content.
+func zstdDictionaryID(d []byte) (uint32, bool) {
+	if len(d) < 8 || binary.LittleEndian.Uint32(d) != 0xEC30A437 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(d[4:]), true
+}
+
+// TrainZstdDictionary trains a zstd dictionary of at most maxSize bytes from
+// the request bodies of records, e.g. captured with Capture, for use as
+// PostCompressed.Dictionary.
+//
+// id is the dictionary ID; if 0, a random one is selected. If maxSize is 0, it
+// defaults to 64KiB.
+func TrainZstdDictionary(records []Record, id uint32, maxSize int) ([]byte, error) {
+	if maxSize == 0 {
+		maxSize = 64 << 10
+	}
+	var samples [][]byte
+	for _, r := range records {
+		if r.Request == nil || r.Request.GetBody == nil {
+			continue
+		}
+		b, err := r.Request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		sample, err := io.ReadAll(b)
+		if err2 := b.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(sample) != 0 {
+			samples = append(samples, sample)
+		}
 	}
-	return nil, fmt.Errorf("invalid Encoding value: %q", p.Encoding)
+	return dict.BuildZstdDict(samples, dict.Options{MaxDictSize: maxSize, HashBytes: 6, ZstdDictID: id})
 }
@@ -5,10 +5,15 @@
 package roundtrippers_test
 
 import (
+	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -32,6 +37,38 @@ func TestPostCompressed_error_compress_missing(t *testing.T) {
 	}
 }
 
+func TestNewPostCompressed(t *testing.T) {
+	if _, err := roundtrippers.NewPostCompressed(http.DefaultTransport, "zstd", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := roundtrippers.NewPostCompressed(http.DefaultTransport, "br", 11); err != nil {
+		t.Fatal(err)
+	}
+	var eerr *roundtrippers.InvalidEncodingError
+	if _, err := roundtrippers.NewPostCompressed(http.DefaultTransport, "bad", 0); !errors.As(err, &eerr) || eerr.Encoding != "bad" {
+		t.Fatal(err)
+	}
+	if _, err := roundtrippers.NewPostCompressed(http.DefaultTransport, "", 0); !errors.As(err, &eerr) {
+		t.Fatal(err)
+	}
+	var lerr *roundtrippers.InvalidLevelError
+	if _, err := roundtrippers.NewPostCompressed(http.DefaultTransport, "zstd", 5); !errors.As(err, &lerr) || lerr.Max != 4 {
+		t.Fatal(err)
+	}
+	if _, err := roundtrippers.NewPostCompressed(http.DefaultTransport, "gzip", -1); !errors.As(err, &lerr) || lerr.Min != 1 {
+		t.Fatal(err)
+	}
+}
+
+func TestPostCompressed_error_level(t *testing.T) {
+	c := http.Client{Transport: &roundtrippers.PostCompressed{Transport: http.DefaultTransport, Encoding: "gzip", Level: 10}}
+	_, err := c.Post("http://127.0.0.1:0", "text/plain", strings.NewReader("hello"))
+	var lerr *roundtrippers.InvalidLevelError
+	if !errors.As(err, &lerr) {
+		t.Fatal(err)
+	}
+}
+
 func TestPostCompressed_get(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("world"))
@@ -60,6 +97,7 @@ func TestPostCompressed(t *testing.T) {
 		decomp func(t *testing.T, r io.ReadCloser) []byte
 	}{
 		{"gzip", decompGZIP},
+		{"deflate", decompDeflate},
 		{"br", decompBR},
 		{"zstd", decompZSTD},
 	}
@@ -170,6 +208,303 @@ func TestPostCompressed_redirect(t *testing.T) {
 	}
 }
 
+func TestPostCompressed_thresholds(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b []byte
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			b = decompGZIP(t, r.Body)
+			_, _ = w.Write([]byte("compressed:"))
+		} else {
+			b, _ = io.ReadAll(r.Body)
+		}
+		_, _ = w.Write(b)
+	}))
+	defer ts.Close()
+	data := []struct {
+		name        string
+		p           *roundtrippers.PostCompressed
+		contentType string
+		body        io.Reader
+		want        string
+	}{
+		{"small", &roundtrippers.PostCompressed{MinSize: 10}, "text/plain", strings.NewReader("hello"), "hello"},
+		{"small_no_GetBody", &roundtrippers.PostCompressed{MinSize: 10}, "text/plain", &reader{"hello"}, "hello"},
+		{"large", &roundtrippers.PostCompressed{MinSize: 5}, "text/plain", strings.NewReader("hello"), "compressed:hello"},
+		{"jpeg", &roundtrippers.PostCompressed{}, "image/jpeg", strings.NewReader("hello"), "hello"},
+		{"video", &roundtrippers.PostCompressed{}, "video/mp4; codecs=\"avc1\"", strings.NewReader("hello"), "hello"},
+		{"skip_disabled", &roundtrippers.PostCompressed{SkipContentTypes: []string{}}, "image/jpeg", strings.NewReader("hello"), "compressed:hello"},
+		{"allowed", &roundtrippers.PostCompressed{ContentTypes: []string{"text/*"}}, "text/csv", strings.NewReader("hello"), "compressed:hello"},
+		{"not_allowed", &roundtrippers.PostCompressed{ContentTypes: []string{"application/json"}}, "text/plain", strings.NewReader("hello"), "hello"},
+	}
+	for _, line := range data {
+		t.Run(line.name, func(t *testing.T) {
+			line.p.Transport = http.DefaultTransport
+			line.p.Encoding = "gzip"
+			c := http.Client{Transport: line.p}
+			resp, err := c.Post(ts.URL, line.contentType, line.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := string(b); s != line.want {
+				t.Fatalf("want %q, got %q", line.want, s)
+			}
+		})
+	}
+}
+
+func TestPostCompressed_Fallback(t *testing.T) {
+	var compressed, plain atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "" {
+			compressed.Add(1)
+			http.Error(w, "no thanks", http.StatusUnsupportedMediaType)
+			return
+		}
+		plain.Add(1)
+		b, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(b)
+	}))
+	defer ts.Close()
+	p := &roundtrippers.PostCompressed{Transport: http.DefaultTransport, Encoding: "zstd", Fallback: true}
+	c := http.Client{Transport: p}
+	for i, body := range []io.Reader{strings.NewReader("hello"), &reader{"hello"}, strings.NewReader("hello")} {
+		if i == 2 {
+			// PostCompressed can be copied by value; the copy shares the hosts known
+			// to not support compressed requests.
+			p2 := *p
+			c.Transport = &p2
+		}
+		resp, err := c.Post(ts.URL, "text/plain", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != "hello" || resp.StatusCode != 200 {
+			t.Fatal(resp.StatusCode, s)
+		}
+	}
+	// The following requests skipped compression.
+	if v := compressed.Load(); v != 1 {
+		t.Fatalf("expected 1 compressed request, got %d", v)
+	}
+	if v := plain.Load(); v != 3 {
+		t.Fatalf("expected 3 plain requests, got %d", v)
+	}
+}
+
+func TestPostCompressed_ContentLength(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := decompZSTD(t, r.Body)
+		_, _ = fmt.Fprintf(w, "%d:%s", r.ContentLength, b)
+	}))
+	defer ts.Close()
+	c := http.Client{Transport: &roundtrippers.PostCompressed{Transport: http.DefaultTransport, Encoding: "zstd"}}
+	large := strings.Repeat("hello", 1<<20)
+	data := []struct {
+		name    string
+		getBody bool
+		body    io.Reader
+		want    string
+	}{
+		// Known size, compressed synchronously.
+		{"bytes", false, strings.NewReader("hello"), "18:hello"},
+		// Buffered by PostCompressed, compressed synchronously.
+		{"buffered", false, &reader{"hello"}, "18:hello"},
+		// Unknown size with a GetBody, streamed.
+		{"streamed", true, &reader{"hello"}, "-1:hello"},
+		// Large with a GetBody, streamed to not hold it in memory.
+		{"large", true, strings.NewReader(large), "-1:" + large},
+	}
+	for _, line := range data {
+		t.Run(line.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(t.Context(), "POST", ts.URL, line.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line.getBody {
+				s := "hello"
+				if line.name == "large" {
+					s = large
+				}
+				req.GetBody = func() (io.ReadCloser, error) {
+					return io.NopCloser(&reader{s}), nil
+				}
+			}
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := string(b); s != line.want {
+				t.Fatalf("want %q, got %q", line.want, s)
+			}
+		})
+	}
+}
+
+func TestPostCompressed_Dictionary(t *testing.T) {
+	doc := func(i int) string {
+		return fmt.Sprintf(`{"id":%d,"name":"user%d","email":"user%d@example.com","active":true,"roles":["reader","writer"]}`, i, i, i)
+	}
+	// Capture some requests to train the dictionary on.
+	ch := make(chan roundtrippers.Record, 1)
+	capture := &roundtrippers.Capture{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+		}),
+		C: ch,
+	}
+	var records []roundtrippers.Record
+	for i := range 100 {
+		req, err := http.NewRequestWithContext(t.Context(), "POST", "http://localhost", strings.NewReader(doc(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := capture.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		records = append(records, <-ch)
+	}
+	zdict, err := roundtrippers.TrainZstdDictionary(records, 42, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []struct {
+		name   string
+		p      *roundtrippers.PostCompressed
+		header string
+		id     uint32
+		dec    zstd.DOption
+	}{
+		{
+			"trained",
+			&roundtrippers.PostCompressed{Dictionary: zdict},
+			"X-Zstd-Dictionary-ID",
+			42,
+			zstd.WithDecoderDicts(zdict),
+		},
+		{
+			"raw",
+			&roundtrippers.PostCompressed{Dictionary: []byte(doc(0)), DictionaryID: 7, DictionaryHeader: "Dict"},
+			"Dict",
+			7,
+			zstd.WithDecoderDictRaw(7, []byte(doc(0))),
+		},
+	}
+	for _, line := range data {
+		t.Run(line.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if id := r.Header.Get(line.header); id != strconv.Itoa(int(line.id)) {
+					t.Errorf("unexpected dictionary ID %q", id)
+				}
+				raw, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// The frame must reference the dictionary.
+				var h zstd.Header
+				if err = h.Decode(raw); err != nil || h.DictionaryID != line.id {
+					t.Errorf("unexpected frame dictionary ID %d: %v", h.DictionaryID, err)
+				}
+				zs, err := zstd.NewReader(bytes.NewReader(raw), line.dec)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer zs.Close()
+				_, _ = io.Copy(w, zs)
+			}))
+			defer ts.Close()
+			line.p.Transport = http.DefaultTransport
+			line.p.Encoding = "zstd"
+			c := http.Client{Transport: line.p}
+			resp, err := c.Post(ts.URL, "application/json", strings.NewReader(doc(1000)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := string(b); s != doc(1000) {
+				t.Fatal(s)
+			}
+		})
+	}
+}
+
+func TestPostCompressed_Dictionary_replace(t *testing.T) {
+	dict1 := []byte(strings.Repeat("first dictionary ", 10))
+	dict2 := []byte(strings.Repeat("second dictionary ", 10))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var h zstd.Header
+		if err = h.Decode(raw); err != nil || strconv.Itoa(int(h.DictionaryID)) != r.Header.Get("X-Zstd-Dictionary-ID") {
+			t.Errorf("unexpected frame dictionary ID %d: %v", h.DictionaryID, err)
+		}
+		zs, err := zstd.NewReader(bytes.NewReader(raw), zstd.WithDecoderDictRaw(1, dict1), zstd.WithDecoderDictRaw(2, dict2))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer zs.Close()
+		_, _ = io.Copy(w, zs)
+	}))
+	defer ts.Close()
+	p := &roundtrippers.PostCompressed{Transport: http.DefaultTransport, Encoding: "zstd", Dictionary: dict1, DictionaryID: 1}
+	c := http.Client{Transport: p}
+	for i, d := range [][]byte{dict1, dict2} {
+		// The encoders of the previous dictionary must not be reused.
+		p.Dictionary = d
+		p.DictionaryID = uint32(i + 1)
+		resp, err := c.Post(ts.URL, "text/plain", strings.NewReader("second dictionary first dictionary"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != "second dictionary first dictionary" {
+			t.Fatal(s)
+		}
+	}
+}
+
+func TestPostCompressed_Dictionary_raw_no_id(t *testing.T) {
+	c := http.Client{Transport: &roundtrippers.PostCompressed{
+		Transport:  http.DefaultTransport,
+		Encoding:   "zstd",
+		Dictionary: []byte("some raw dictionary content"),
+	}}
+	if _, err := c.Post("http://127.0.0.1:0", "text/plain", strings.NewReader("hello")); err == nil || !strings.Contains(err.Error(), "DictionaryID") {
+		t.Fatal(err)
+	}
+}
+
 func TestPostCompressed_Unwrap(t *testing.T) {
 	var r http.RoundTripper = &roundtrippers.PostCompressed{Transport: http.DefaultTransport}
 	if r.(roundtrippers.Unwrapper).Unwrap() != http.DefaultTransport {
@@ -200,6 +535,27 @@ func decompGZIP(t *testing.T, r io.ReadCloser) []byte {
 	return b
 }
 
+func decompDeflate(t *testing.T, r io.ReadCloser) []byte {
+	defer func() {
+		if err2 := r.Close(); err2 != nil {
+			t.Error(err2)
+		}
+	}()
+	zl, err := zlib.NewReader(r)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	b, err := io.ReadAll(zl)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = zl.Close(); err != nil {
+		t.Error(err)
+	}
+	return b
+}
+
 func decompBR(t *testing.T, r io.ReadCloser) []byte {
 	defer func() {
 		if err2 := r.Close(); err2 != nil {
@@ -244,3 +600,9 @@ func (r *reader) Read(b []byte) (int, error) {
 	}
 	return i, nil
 }
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (r roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r(req)
+}
@@ -0,0 +1,148 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRetryAfter returns the delay the server asked to wait before retrying.
+//
+// Retry-After is always honored. The rate limit headers are only used on HTTP
+// 429 since they are sent along successful responses too.
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	now := time.Now()
+	if d, ok := parseRetryAfterHeader(resp.Header.Get("Retry-After"), now); ok {
+		return d, true
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if d, ok := parseRateLimitHeader(resp.Header.Get("RateLimit"), resp.Header.Get("RateLimit-Policy")); ok {
+		return d, true
+	}
+	if d, ok := parseSeconds(resp.Header.Get("RateLimit-Reset")); ok {
+		return d, true
+	}
+	return parseResetHeader(resp.Header.Get("X-RateLimit-Reset"), now)
+}
+
+// parseRetryAfterHeader parses the Retry-After header as defined in RFC 9110
+// section 10.2.3. It is either a number of seconds or a HTTP-date, which can be
+// in the IMF-fixdate, RFC 850 or asctime format.
+func parseRetryAfterHeader(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if d, ok := parseSeconds(header); ok {
+		return d, true
+	}
+	if retryTime, err := http.ParseTime(header); err == nil {
+		if until := retryTime.Sub(now); until > 0 {
+			return until, true
+		}
+	}
+	return 0, false
+}
+
+// parseRateLimitHeader parses the IETF RateLimit header and returns the reset
+// delay of the exhausted quota policies.
+//
+// It supports both the structured field syntax from
+// draft-ietf-httpapi-ratelimit-headers-07 and later, e.g. `"default";r=0;t=30`,
+// and the older `limit=100, remaining=0, reset=30` syntax. When the reset is not
+// specified, the window from RateLimit-Policy is used.
+//
+// See https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+func parseRateLimitHeader(header, policy string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	var out time.Duration
+	found := false
+	exhausted := false
+	// Parameters of the older syntax are spread over the list items.
+	legacy := map[string]string{}
+	for _, item := range strings.Split(header, ",") {
+		params := parseParams(item)
+		if v, ok := params["reset"]; ok {
+			legacy["reset"] = v
+		}
+		if v, ok := params["remaining"]; ok {
+			legacy["remaining"] = v
+		}
+		if r, ok := params["r"]; ok && r != "0" {
+			continue
+		} else if ok {
+			exhausted = true
+		}
+		if d, ok := parseSeconds(params["t"]); ok {
+			out = max(out, d)
+			found = true
+		}
+	}
+	if r, ok := legacy["remaining"]; !ok || r == "0" {
+		if d, ok := parseSeconds(legacy["reset"]); ok {
+			out = max(out, d)
+			found = true
+		}
+	}
+	if !found && exhausted {
+		for _, item := range strings.Split(policy, ",") {
+			if d, ok := parseSeconds(parseParams(item)["w"]); ok {
+				out = max(out, d)
+				found = true
+			}
+		}
+	}
+	return out, found
+}
+
+// parseResetHeader parses X-RateLimit-Reset. Depending on the server, it is
+// either a number of seconds or a Unix timestamp, the latter being
+// distinguished by being larger than 10⁹, i.e. after 2001.
+func parseResetHeader(header string, now time.Time) (time.Duration, bool) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(header), 64)
+	if err != nil || v <= 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, false
+	}
+	if v > 1e9 {
+		sec, frac := math.Modf(v)
+		if until := time.Unix(int64(sec), int64(frac*1e9)).Sub(now); until > 0 {
+			return until, true
+		}
+		return 0, false
+	}
+	return parseSeconds(header)
+}
+
+// parseSeconds parses a positive number of seconds, optionally fractional.
+func parseSeconds(s string) (time.Duration, bool) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || v <= 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, false
+	}
+	if v >= math.MaxInt64/2/float64(time.Second) {
+		// Protect against overflow when converting to time.Duration.
+		return math.MaxInt64 / 2, true
+	}
+	return time.Duration(v * float64(time.Second)), true
+}
+
+// parseParams parses the "key=value" parameters of a list item separated by
+// ";". Quotes are removed from the values.
+func parseParams(item string) map[string]string {
+	out := map[string]string{}
+	for _, p := range strings.Split(item, ";") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok {
+			out[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"`)
+		}
+	}
+	return out
+}
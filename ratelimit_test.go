@@ -0,0 +1,51 @@
+// Copyright 2025 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package roundtrippers
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	future := now.Add(10 * time.Second).UTC()
+	data := []struct {
+		code int
+		hdr  http.Header
+		want time.Duration
+	}{
+		{503, http.Header{"Retry-After": {"3"}}, 3 * time.Second},
+		{503, http.Header{"Retry-After": {"0"}}, 0},
+		{503, http.Header{"Retry-After": {"foo"}}, 0},
+		{503, http.Header{"Retry-After": {future.Format(http.TimeFormat)}}, 10 * time.Second},
+		{503, http.Header{"Retry-After": {future.Format(time.RFC850)}}, 10 * time.Second},
+		{503, http.Header{"Retry-After": {future.Format(time.ANSIC)}}, 10 * time.Second},
+		{503, http.Header{"Retry-After": {now.Add(-10 * time.Second).UTC().Format(http.TimeFormat)}}, 0},
+		// Rate limit headers are ignored unless HTTP 429.
+		{503, http.Header{"X-Ratelimit-Reset": {"5"}}, 0},
+		{429, http.Header{"X-Ratelimit-Reset": {"5"}}, 5 * time.Second},
+		{429, http.Header{"X-Ratelimit-Reset": {strconv.FormatInt(future.Unix(), 10)}}, 10 * time.Second},
+		{429, http.Header{"Ratelimit-Reset": {"7"}}, 7 * time.Second},
+		{429, http.Header{"Ratelimit": {`"default";r=0;t=30`}}, 30 * time.Second},
+		{429, http.Header{"Ratelimit": {`"a";r=0;t=30, "b";r=0;t=50, "c";r=10;t=90`}}, 50 * time.Second},
+		{429, http.Header{"Ratelimit": {`"a";r=5;t=30`}}, 0},
+		{429, http.Header{"Ratelimit": {`"a";r=0`}, "Ratelimit-Policy": {`"a";q=100;w=60`}}, 60 * time.Second},
+		{429, http.Header{"Ratelimit": {`limit=100, remaining=0, reset=20`}}, 20 * time.Second},
+		{429, http.Header{"Ratelimit": {`limit=100, remaining=3, reset=20`}}, 0},
+		// Retry-After takes precedence.
+		{429, http.Header{"Retry-After": {"1"}, "Ratelimit-Reset": {"7"}}, time.Second},
+	}
+	for i, line := range data {
+		resp := &http.Response{StatusCode: line.code, Header: line.hdr}
+		got, ok := parseRetryAfter(resp)
+		// Allow for the clock advancing during the test.
+		if ok != (line.want != 0) || got > line.want || got < line.want-time.Second {
+			t.Errorf("#%d: %v: got %s, %t; want %s", i, line.hdr, got, ok, line.want)
+		}
+	}
+}
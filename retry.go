@@ -6,13 +6,14 @@ package roundtrippers
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"math"
+	"math/rand/v2"
 	"net/http"
-	"net/url"
-	"regexp"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -23,6 +24,33 @@ type Retry struct {
 	//
 	// If unset, defaults to DefaultRetryPolicy.
 	Policy RetryPolicy
+	// Budget optionally limits the number of retries across all requests. It
+	// can be shared between multiple Retry instances.
+	Budget *RetryBudget
+	// AttemptTimeout optionally limits the time to receive the response headers
+	// of each try. A try that times out returns ErrAttemptTimeout, which
+	// ExponentialBackoff retries when the request has an idempotent method or an
+	// Idempotency-Key header. It doesn't limit the time to read the
+	// response body.
+	AttemptTimeout time.Duration
+	// OnRetry is optionally called before sleeping for each retry.
+	OnRetry func(req *http.Request, e RetryEvent)
+	// AttemptHeader optionally is the name of a header set to the attempt number
+	// on each try, e.g. "X-Retry-Attempt". The first try is attempt 1.
+	AttemptHeader string
+	// RequireIdempotencyKey only retries requests with a non-idempotent method,
+	// e.g. POST or PATCH, when they have an Idempotency-Key header.
+	//
+	// See https://datatracker.ietf.org/doc/draft-ietf-httpapi-idempotency-key-header/
+	RequireIdempotencyKey bool
+	// AddIdempotencyKey adds a random Idempotency-Key header to requests with a
+	// non-idempotent method that do not have one. The same key is sent on all
+	// tries.
+	AddIdempotencyKey bool
+	// MaxRetryAfter optionally caps the delay a server can ask for via the
+	// Retry-After or rate limit headers. When exceeded, Retry returns a
+	// *RetryAfterError instead of sleeping.
+	MaxRetryAfter time.Duration
 	// TimeAfter can be hooked for unit tests to disable sleeping. It defaults to time.After().
 	TimeAfter func(d time.Duration) <-chan time.Time
 }
@@ -38,13 +66,46 @@ func (r *Retry) RoundTrip(req *http.Request) (*http.Response, error) {
 	if req, err = cloneRequestWithBody(req); err != nil {
 		return nil, err
 	}
-	resp, err := r.Transport.RoundTrip(req)
-	ctx := req.Context()
+	idempotent := isIdempotent(req.Method)
+	if r.AddIdempotencyKey && !idempotent && req.Header.Get("Idempotency-Key") == "" {
+		req.Header.Set("Idempotency-Key", genID())
+	}
+	replayable := idempotent || req.Header.Get("Idempotency-Key") != ""
+	retriable := !r.RequireIdempotencyKey || replayable
+	resp, err := r.try(req, 1)
+	ctx := context.WithValue(req.Context(), replayableKey{}, replayable)
 	timeAfter := r.TimeAfter
 	if timeAfter == nil {
 		timeAfter = time.After
 	}
-	for try := 0; policy.ShouldRetry(ctx, start, try, err, resp); try++ {
+	for try := 0; retriable && policy.ShouldRetry(ctx, start, try, err, resp); try++ {
+		var sleep time.Duration
+		ok := false
+		if resp != nil {
+			// "Retry-After" is generally sent along HTTP 429. If the server sent
+			// this header or a rate limit header, use this instead of our backoff
+			// algorithm.
+			if sleep, ok = parseRetryAfter(resp); ok && r.MaxRetryAfter > 0 && sleep > r.MaxRetryAfter {
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+				return nil, &RetryAfterError{StatusCode: resp.StatusCode, Wait: sleep, Max: r.MaxRetryAfter}
+			}
+		}
+		if !ok {
+			sleep = policy.Backoff(start, try)
+		} else if p, ok := policy.(RetryAfterPolicy); ok && !p.AllowRetryAfter(start, try, sleep) {
+			// The policy doesn't want to wait as long as the server asked, return
+			// the current response instead.
+			return resp, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < sleep {
+			// The retry would happen after the context is canceled, return the
+			// current response instead.
+			return resp, err
+		}
+		if r.Budget != nil && !r.Budget.Withdraw() {
+			return resp, err
+		}
 		if req.GetBody != nil {
 			var err2 error
 			if req.Body, err2 = req.GetBody(); err2 != nil {
@@ -55,16 +116,12 @@ func (r *Retry) RoundTrip(req *http.Request) (*http.Response, error) {
 		if deep, ok := Unwrap(r.Transport).(*http.Transport); ok {
 			deep.CloseIdleConnections()
 		}
-		var sleep time.Duration
-		if resp != nil {
-			// "Retry-After" is generally sent along HTTP 429. If the server then this header, use this instead of our
-			// backoff algorithm.
-			ok := false
-			if sleep, ok = parseRetryAfterHeader(resp.Header.Get("Retry-After")); !ok {
-				sleep = policy.Backoff(start, try)
+		if r.OnRetry != nil {
+			e := RetryEvent{Attempt: try + 1, Err: err, Sleep: sleep}
+			if resp != nil {
+				e.StatusCode = resp.StatusCode
 			}
-		} else {
-			sleep = policy.Backoff(start, try)
+			r.OnRetry(req, e)
 		}
 		select {
 		case <-ctx.Done():
@@ -76,7 +133,10 @@ func (r *Retry) RoundTrip(req *http.Request) (*http.Response, error) {
 			_, _ = io.Copy(io.Discard, resp.Body)
 			_ = resp.Body.Close()
 		}
-		resp, err = r.Transport.RoundTrip(req)
+		resp, err = r.try(req, try+2)
+	}
+	if r.Budget != nil && err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		r.Budget.Deposit()
 	}
 	return resp, err
 }
@@ -86,19 +146,211 @@ func (r *Retry) Unwrap() http.RoundTripper {
 	return r.Transport
 }
 
+// RetryEvent describes a failed try that is about to be retried.
+type RetryEvent struct {
+	// Attempt is the number of the try that failed, starting at 1.
+	Attempt int
+	// Err is the error returned by the try, if any.
+	Err error
+	// StatusCode is the HTTP status code of the try, or 0 if Err is set.
+	StatusCode int
+	// Sleep is the delay before the next try.
+	Sleep time.Duration
+}
+
+// RetryAttempt returns the attempt number of the request when called from a
+// http.RoundTripper wrapped by Retry, starting at 1. It returns 0 when the
+// request is not sent by Retry.
+func RetryAttempt(ctx context.Context) int {
+	v, _ := ctx.Value(retryAttemptKey{}).(int)
+	return v
+}
+
+type retryAttemptKey struct{}
+
+// replayableKey is set by Retry in the context passed to RetryPolicy. The value
+// is true when the request has an idempotent method or an Idempotency-Key
+// header.
+type replayableKey struct{}
+
+// RetryAfterError is returned by Retry when the server asked to wait longer
+// than MaxRetryAfter.
+type RetryAfterError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Wait is the delay asked by the server.
+	Wait time.Duration
+	// Max is Retry.MaxRetryAfter.
+	Max time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("roundtrippers.Retry: HTTP %d: server asked to retry after %s, more than %s", e.StatusCode, e.Wait, e.Max)
+}
+
+// ErrAttemptTimeout is returned by Retry when a try exceeded AttemptTimeout.
+var ErrAttemptTimeout = errors.New("roundtrippers.Retry: attempt timed out")
+
+// try does a single try, enforcing AttemptTimeout.
+func (r *Retry) try(req *http.Request, attempt int) (*http.Response, error) {
+	ctx := context.WithValue(req.Context(), retryAttemptKey{}, attempt)
+	if r.AttemptHeader != "" {
+		// Clone so inner RoundTrippers that keep the request, like Capture, see
+		// the header value of their own try.
+		req = req.Clone(ctx)
+		req.Header.Set(r.AttemptHeader, strconv.Itoa(attempt))
+	} else {
+		req = req.WithContext(ctx)
+	}
+	if r.AttemptTimeout <= 0 {
+		return r.Transport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	// Only the wait for the headers is limited; the timer is stopped once they
+	// are received so the body can be read at the caller's pace.
+	t := time.AfterFunc(r.AttemptTimeout, func() { cancel(ErrAttemptTimeout) })
+	resp, err := r.Transport.RoundTrip(req.WithContext(ctx))
+	if !t.Stop() && context.Cause(ctx) == ErrAttemptTimeout {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return nil, ErrAttemptTimeout
+	}
+	if err != nil {
+		cancel(nil)
+		return resp, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody cancels the try's context when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelCauseFunc
+}
+
+func (c *cancelBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel(nil)
+	return err
+}
+
+// RetryBudget is a token bucket that caps retries at a ratio of successful
+// requests, to not amplify the load on a server that is already failing.
+//
+// Successful requests deposit Ratio tokens and each retry withdraws one. It is
+// the same algorithm as gRPC retry throttling.
+//
+// It is safe for concurrent use.
+type RetryBudget struct {
+	// Ratio is the number of retries allowed per successful request, e.g. 0.1
+	// allows retries to be up to 10% of the traffic. Defaults to 0.1.
+	Ratio float64
+	// MaxTokens is the maximum number of tokens, i.e. the number of retries
+	// allowed in a burst. The bucket starts full. Defaults to 10.
+	MaxTokens float64
+
+	mu     sync.Mutex
+	tokens float64
+	init   bool
+}
+
+// Deposit records a successful request.
+func (b *RetryBudget) Deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lazyInit()
+	b.tokens = min(b.tokens+b.ratio(), b.maxTokens())
+}
+
+// Withdraw returns true if a retry is allowed and consumes a token.
+func (b *RetryBudget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lazyInit()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *RetryBudget) lazyInit() {
+	if !b.init {
+		b.init = true
+		b.tokens = b.maxTokens()
+	}
+}
+
+func (b *RetryBudget) ratio() float64 {
+	if b.Ratio <= 0 {
+		return 0.1
+	}
+	return b.Ratio
+}
+
+func (b *RetryBudget) maxTokens() float64 {
+	if b.MaxTokens <= 0 {
+		return 10
+	}
+	return b.MaxTokens
+}
+
 // RetryPolicy determines when Retry should retry an HTTP request.
 type RetryPolicy interface {
 	ShouldRetry(ctx context.Context, start time.Time, try int, err error, resp *http.Response) bool
 	Backoff(start time.Time, try int) time.Duration
 }
 
+// RetryAfterPolicy is optionally implemented by a RetryPolicy to decide
+// whether to wait for the delay a server asked for via the Retry-After or rate
+// limit headers. A RetryPolicy wrapping another one should forward it.
+type RetryAfterPolicy interface {
+	// AllowRetryAfter returns false when Retry should return the response
+	// instead of waiting d before retrying.
+	AllowRetryAfter(start time.Time, try int, d time.Duration) bool
+}
+
 // ExponentialBackoff uses exponential backoff.
+//
+// The delay before each retry is InitialDelay * Exp^try, capped at MaxDelay and
+// at the time remaining in MaxDuration. When a server asks via Retry-After to
+// wait past MaxDuration, Retry returns the response instead of retrying.
 type ExponentialBackoff struct {
 	MaxTryCount int
 	MaxDuration time.Duration
 	Exp         float64
+	// InitialDelay is the delay before the first retry. Defaults to 1s.
+	InitialDelay time.Duration
+	// MaxDelay caps a single delay. Defaults to no cap.
+	MaxDelay time.Duration
+	// Jitter randomizes the delay so that clients failing at the same time do not
+	// retry at the same time. Defaults to NoJitter.
+	Jitter Jitter
+	// Rand returns a pseudo-random number in [0.0, 1.0). It can be hooked for
+	// unit tests. It defaults to rand.Float64() from math/rand/v2.
+	Rand func() float64
 }
 
+// Jitter is a strategy to randomize ExponentialBackoff delays.
+//
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+type Jitter int
+
+const (
+	// NoJitter uses the exponential delay as is.
+	NoJitter Jitter = iota
+	// FullJitter uses a random delay between 0 and the exponential delay.
+	FullJitter
+	// EqualJitter uses half the exponential delay plus a random delay up to the
+	// other half.
+	EqualJitter
+	// DecorrelatedJitter uses a random delay between InitialDelay and three times
+	// the previous try's exponential delay.
+	DecorrelatedJitter
+)
+
 // DefaultRetryPolicy is a reasonable default policy.
 var DefaultRetryPolicy = ExponentialBackoff{
 	MaxTryCount: 3,
@@ -107,69 +359,77 @@ var DefaultRetryPolicy = ExponentialBackoff{
 }
 
 func (e *ExponentialBackoff) ShouldRetry(ctx context.Context, start time.Time, try int, err error, resp *http.Response) bool {
-	if try >= e.MaxTryCount || time.Since(start) > e.MaxDuration || ctx.Err() != nil || isNotRetriableError(err) {
+	if try >= e.MaxTryCount || time.Since(start) > e.MaxDuration || ctx.Err() != nil {
 		return false
 	}
-	if resp == nil {
-		// Seems to happen often with Google frontend.
-		if err != nil && http2StreamError.MatchString(err.Error()) {
-			return true
-		}
-		return false
+	if err != nil || resp == nil {
+		replayable, _ := ctx.Value(replayableKey{}).(bool)
+		return Classify(err).Retriable(replayable)
 	}
-	code := resp.StatusCode
-	return code == http.StatusTooManyRequests || // 429
-		code == http.StatusBadGateway || // 502
-		code == http.StatusServiceUnavailable || // 503
-		code == http.StatusGatewayTimeout || // 504
-		code == 524 || // Cloudflare non-standard code. See https://http.dev/524
-		code == 529 // Qualys non-standard code. See https://http.dev/529
+	return isRetriableStatus(resp.StatusCode)
 }
 
-func (e *ExponentialBackoff) Backoff(start time.Time, try int) time.Duration {
-	return time.Duration(math.Pow(e.Exp, float64(try))) * time.Second
+// AllowRetryAfter implements RetryAfterPolicy. It refuses to wait past
+// MaxDuration.
+func (e *ExponentialBackoff) AllowRetryAfter(start time.Time, try int, d time.Duration) bool {
+	return d <= e.MaxDuration-time.Since(start)
 }
 
-//
-
-// List of regexes used to match errors returned by net/http. These are not typed specifically so we resort to
-// matching on the error string. This is not ideal.
-var (
-	// redirectsErrorRe matches the error returned by net/http when the configured number of redirects is
-	// exhausted.
-	redirectsErrorRe = regexp.MustCompile(`stopped after \d+ redirects\z`)
-	// schemeErrorRe matches the error returned by net/http when the scheme specified in the URL is invalid.
-	schemeErrorRe = regexp.MustCompile(`unsupported protocol scheme`)
-	// invalidHeaderErrorRe matches the error returned by net/http when a request header or value is invalid.
-	invalidHeaderErrorRe = regexp.MustCompile(`invalid header`)
-	// notTrustedErrorRe matches the error returned by net/http when the TLS certificate is not trusted.
-	notTrustedErrorRe = regexp.MustCompile(`certificate is not trusted`)
-	// http2StreamError matches the error returned by net/http when a HTTP/2 stream is closed.
-	http2StreamError = regexp.MustCompile(`stream error: stream ID \d+; INTERNAL_ERROR; received from peer`)
-)
-
-func parseRetryAfterHeader(header string) (time.Duration, bool) {
-	if sleep, err := strconv.ParseInt(header, 10, 64); err == nil {
-		if sleep > 0 {
-			return time.Second * time.Duration(sleep), true
+func (e *ExponentialBackoff) Backoff(start time.Time, try int) time.Duration {
+	initial := float64(e.InitialDelay)
+	if initial <= 0 {
+		initial = float64(time.Second)
+	}
+	d := initial * math.Pow(e.Exp, float64(try))
+	if e.Jitter != NoJitter {
+		rnd := e.Rand
+		if rnd == nil {
+			rnd = rand.Float64
 		}
-	} else if retryTime, err := time.Parse(time.RFC1123, header); err == nil {
-		if until := time.Until(retryTime); until > 0 {
-			return until, true
+		switch e.Jitter {
+		case FullJitter:
+			d *= rnd()
+		case EqualJitter:
+			d = d/2 + rnd()*d/2
+		case DecorrelatedJitter:
+			// The policy is stateless so the previous delay is approximated with the
+			// previous try's exponential delay.
+			prev := initial * math.Pow(e.Exp, float64(try-1))
+			d = initial + rnd()*max(3*prev-initial, 0)
 		}
 	}
-	return 0, false
+	if e.MaxDelay > 0 {
+		d = min(d, float64(e.MaxDelay))
+	}
+	if e.MaxDuration > 0 {
+		d = min(d, float64(e.MaxDuration-time.Since(start)))
+	}
+	if d >= math.MaxInt64/2 {
+		// Protect against overflow when converting to time.Duration.
+		return math.MaxInt64 / 2
+	}
+	return time.Duration(max(d, 0))
 }
 
-// isNotRetriableError catch untyped errors that must not be retried.
-func isNotRetriableError(err error) bool {
-	if v, ok := err.(*url.Error); ok {
-		if _, ok := v.Err.(*tls.CertificateVerificationError); ok {
-			return true
-		}
-		if s := v.Error(); redirectsErrorRe.MatchString(s) || schemeErrorRe.MatchString(s) || invalidHeaderErrorRe.MatchString(s) || notTrustedErrorRe.MatchString(s) {
-			return true
-		}
+//
+
+// isRetriableStatus returns true if the HTTP status code denotes a server that
+// is overloaded or temporarily unavailable.
+func isRetriableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || // 429
+		code == http.StatusBadGateway || // 502
+		code == http.StatusServiceUnavailable || // 503
+		code == http.StatusGatewayTimeout || // 504
+		code == 524 || // Cloudflare non-standard code. See https://http.dev/524
+		code == 529 // Qualys non-standard code. See https://http.dev/529
+}
+
+// isIdempotent returns true if the method is idempotent as defined in RFC 9110
+// section 9.2.2.
+func isIdempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
 	}
 	return false
 }
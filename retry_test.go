@@ -5,14 +5,18 @@
 package roundtrippers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -246,6 +250,520 @@ func TestRetry_post(t *testing.T) {
 	}
 }
 
+func TestExponentialBackoff_Jitter(t *testing.T) {
+	data := []struct {
+		jitter Jitter
+		try    int
+		want   time.Duration
+	}{
+		{NoJitter, 0, time.Second},
+		{NoJitter, 3, 8 * time.Second},
+		{FullJitter, 0, 250 * time.Millisecond},
+		{FullJitter, 3, 2 * time.Second},
+		{EqualJitter, 0, 625 * time.Millisecond},
+		{EqualJitter, 3, 5 * time.Second},
+		{DecorrelatedJitter, 0, 1125 * time.Millisecond},
+		{DecorrelatedJitter, 3, 3750 * time.Millisecond},
+	}
+	for i, line := range data {
+		e := ExponentialBackoff{Exp: 2, Jitter: line.jitter, Rand: func() float64 { return 0.25 }}
+		if got := e.Backoff(time.Now(), line.try); got != line.want {
+			t.Errorf("#%d: Backoff(%d) = %s, want %s", i, line.try, got, line.want)
+		}
+	}
+	e := ExponentialBackoff{Exp: 2, Jitter: FullJitter}
+	for try := range 5 {
+		if got := e.Backoff(time.Now(), try); got < 0 || got >= time.Duration(1<<try)*time.Second {
+			t.Errorf("Backoff(%d) = %s", try, got)
+		}
+	}
+}
+
+func TestExponentialBackoff_bounds(t *testing.T) {
+	now := time.Now()
+	data := []struct {
+		e     ExponentialBackoff
+		start time.Time
+		try   int
+		want  time.Duration
+	}{
+		{ExponentialBackoff{Exp: 1.5}, now, 1, 1500 * time.Millisecond},
+		{ExponentialBackoff{Exp: 2, InitialDelay: 100 * time.Millisecond}, now, 0, 100 * time.Millisecond},
+		{ExponentialBackoff{Exp: 2, InitialDelay: 100 * time.Millisecond}, now, 3, 800 * time.Millisecond},
+		{ExponentialBackoff{Exp: 10, MaxDelay: 30 * time.Second}, now, 5, 30 * time.Second},
+		{ExponentialBackoff{Exp: 1e10}, now, 1000, math.MaxInt64 / 2},
+		{ExponentialBackoff{Exp: 2, MaxDuration: time.Minute}, now.Add(-time.Hour), 3, 0},
+	}
+	for i, line := range data {
+		if got := line.e.Backoff(line.start, line.try); got != line.want {
+			t.Errorf("#%d: Backoff(%d) = %s, want %s", i, line.try, got, line.want)
+		}
+	}
+	e := ExponentialBackoff{Exp: 2, MaxDuration: 10 * time.Second}
+	if got := e.Backoff(now.Add(-5*time.Second), 5); got <= 4*time.Second || got > 5*time.Second {
+		t.Errorf("Backoff(5) = %s", got)
+	}
+}
+
+func TestRetry_deadline(t *testing.T) {
+	var count atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+	c := http.Client{Transport: &Retry{
+		Transport: http.DefaultTransport,
+		TimeAfter: func(d time.Duration) <-chan time.Time {
+			t.Errorf("unexpected sleep %s", d)
+			c := make(chan time.Time, 1)
+			c <- time.Now()
+			return c
+		},
+	}}
+	ctx, cancel := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != 503 {
+		t.Fatal(resp.StatusCode)
+	}
+	if v := count.Load(); v != 1 {
+		t.Fatalf("expected 1 try, got %d", v)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := RetryBudget{Ratio: 0.5, MaxTokens: 2}
+	if !b.Withdraw() || !b.Withdraw() || b.Withdraw() {
+		t.Fatal("expected 2 retries")
+	}
+	b.Deposit()
+	if b.Withdraw() {
+		t.Fatal("expected no retry")
+	}
+	b.Deposit()
+	if !b.Withdraw() || b.Withdraw() {
+		t.Fatal("expected 1 retry")
+	}
+	for range 10 {
+		b.Deposit()
+	}
+	if !b.Withdraw() || !b.Withdraw() || b.Withdraw() {
+		t.Fatal("expected 2 retries")
+	}
+}
+
+func TestRetryBudget_default(t *testing.T) {
+	b := RetryBudget{MaxTokens: 1}
+	if !b.Withdraw() || b.Withdraw() {
+		t.Fatal("expected 1 retry")
+	}
+	// 0.1 is not exactly representable, deposit once more.
+	for range 11 {
+		b.Deposit()
+	}
+	if !b.Withdraw() {
+		t.Fatal("expected a refill")
+	}
+}
+
+func TestRetry_Budget_deadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+	budget := &RetryBudget{MaxTokens: 3}
+	c := http.Client{Transport: &Retry{Transport: http.DefaultTransport, Budget: budget}}
+	for range 3 {
+		ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+		req, err := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	// No retry was sent so no token was spent.
+	if !budget.Withdraw() || !budget.Withdraw() || !budget.Withdraw() {
+		t.Fatal("expected the budget to be intact")
+	}
+}
+
+func TestRetry_Budget(t *testing.T) {
+	var count atomic.Int64
+	var fail atomic.Bool
+	fail.Store(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		if fail.Load() {
+			w.WriteHeader(503)
+		}
+	}))
+	defer ts.Close()
+	c := http.Client{Transport: &Retry{
+		Transport: http.DefaultTransport,
+		Budget:    &RetryBudget{Ratio: 1, MaxTokens: 3},
+		TimeAfter: func(time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			c <- time.Now()
+			return c
+		},
+	}}
+	get := func(want int) {
+		t.Helper()
+		resp, err := c.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatal(resp.StatusCode)
+		}
+	}
+	// 1 try + 3 retries, then the budget is exhausted.
+	get(503)
+	get(503)
+	if v := count.Swap(0); v != 5 {
+		t.Fatalf("expected 5 tries, got %d", v)
+	}
+	fail.Store(false)
+	get(200)
+	fail.Store(true)
+	get(503)
+	if v := count.Load(); v != 3 {
+		t.Fatalf("expected 3 tries, got %d", v)
+	}
+}
+
+func TestRetry_AttemptTimeout(t *testing.T) {
+	var count atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count.Add(1) == 1 {
+			// Hang the first try until the client gives up.
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		// The body must still be readable after AttemptTimeout elapsed.
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("hi"))
+	}))
+	defer ts.Close()
+	c := http.Client{Transport: &Retry{
+		Transport:      http.DefaultTransport,
+		AttemptTimeout: 100 * time.Millisecond,
+		TimeAfter: func(time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			c <- time.Now()
+			return c
+		},
+	}}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "hi" {
+		t.Fatalf("want \"hi\", got %q", s)
+	}
+	if v := count.Load(); v != 2 {
+		t.Fatalf("expected 2 tries, got %d", v)
+	}
+}
+
+func TestRetry_AttemptTimeout_exhausted(t *testing.T) {
+	var count atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	c := http.Client{Transport: &Retry{
+		Transport:      http.DefaultTransport,
+		AttemptTimeout: 10 * time.Millisecond,
+		TimeAfter: func(time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			c <- time.Now()
+			return c
+		},
+	}}
+	_, err := c.Get(ts.URL)
+	if !errors.Is(err, ErrAttemptTimeout) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := count.Load(); v != 4 {
+		t.Fatalf("expected 4 tries, got %d", v)
+	}
+}
+
+func TestRetry_OnRetry(t *testing.T) {
+	var count atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := count.Add(1)
+		if got := r.Header.Get("X-Retry-Attempt"); got != fmt.Sprint(v) {
+			t.Errorf("want attempt %d, got %q", v, got)
+		}
+		if v < 3 {
+			w.WriteHeader(503)
+			return
+		}
+		_, _ = w.Write([]byte("hi"))
+	}))
+	defer ts.Close()
+	ch := make(chan Record, 3)
+	var events []RetryEvent
+	c := http.Client{Transport: &Retry{
+		Transport:     &Capture{Transport: http.DefaultTransport, C: ch},
+		AttemptHeader: "X-Retry-Attempt",
+		OnRetry: func(req *http.Request, e RetryEvent) {
+			events = append(events, e)
+		},
+		TimeAfter: func(time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			c <- time.Now()
+			return c
+		},
+	}}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	want := []RetryEvent{
+		{Attempt: 1, StatusCode: 503, Sleep: time.Second},
+		{Attempt: 2, StatusCode: 503, Sleep: 2 * time.Second},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("want %d events, got %#v", len(want), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("#%d: want %#v, got %#v", i, want[i], events[i])
+		}
+	}
+	for i := range 3 {
+		r := <-ch
+		if r.Attempt != i+1 {
+			t.Errorf("want attempt %d, got %d", i+1, r.Attempt)
+		}
+		if got := r.Request.Header.Get("X-Retry-Attempt"); got != fmt.Sprint(i+1) {
+			t.Errorf("want header %d, got %q", i+1, got)
+		}
+	}
+}
+
+func TestRetry_IdempotencyKey(t *testing.T) {
+	data := []struct {
+		name  string
+		retry Retry
+		hdr   string
+		tries int64
+	}{
+		{"default", Retry{}, "", 2},
+		{"require", Retry{RequireIdempotencyKey: true}, "", 1},
+		{"require_key", Retry{RequireIdempotencyKey: true}, "abc", 2},
+		{"add", Retry{RequireIdempotencyKey: true, AddIdempotencyKey: true}, "", 2},
+	}
+	for _, line := range data {
+		t.Run(line.name, func(t *testing.T) {
+			var count atomic.Int64
+			var keys []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				keys = append(keys, r.Header.Get("Idempotency-Key"))
+				if count.Add(1) == 1 {
+					w.WriteHeader(503)
+				}
+			}))
+			defer ts.Close()
+			r := line.retry
+			r.Transport = http.DefaultTransport
+			r.TimeAfter = func(time.Duration) <-chan time.Time {
+				c := make(chan time.Time, 1)
+				c <- time.Now()
+				return c
+			}
+			req, err := http.NewRequestWithContext(t.Context(), "POST", ts.URL, strings.NewReader("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line.hdr != "" {
+				req.Header.Set("Idempotency-Key", line.hdr)
+			}
+			c := http.Client{Transport: &r}
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if v := count.Load(); v != line.tries {
+				t.Fatalf("expected %d tries, got %d", line.tries, v)
+			}
+			if line.retry.AddIdempotencyKey {
+				if keys[0] == "" || keys[0] != keys[1] {
+					t.Fatalf("expected a stable key, got %q", keys)
+				}
+			} else if keys[0] != line.hdr {
+				t.Fatalf("want key %q, got %q", line.hdr, keys[0])
+			}
+		})
+	}
+}
+
+func TestRetry_MaxRetryAfter(t *testing.T) {
+	var count atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		w.Header().Set("RateLimit", `"default";r=0;t=3600`)
+		w.WriteHeader(429)
+	}))
+	defer ts.Close()
+	c := http.Client{Transport: &Retry{
+		Transport:     http.DefaultTransport,
+		MaxRetryAfter: time.Minute,
+		TimeAfter: func(d time.Duration) <-chan time.Time {
+			t.Errorf("unexpected sleep %s", d)
+			c := make(chan time.Time, 1)
+			c <- time.Now()
+			return c
+		},
+	}}
+	_, err := c.Get(ts.URL)
+	var rerr *RetryAfterError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rerr.StatusCode != 429 || rerr.Wait != time.Hour || rerr.Max != time.Minute {
+		t.Fatalf("unexpected error: %#v", rerr)
+	}
+	if v := count.Load(); v != 1 {
+		t.Fatalf("expected 1 try, got %d", v)
+	}
+}
+
+func TestRetry_transport_error(t *testing.T) {
+	data := []struct {
+		method string
+		key    string
+		err    error
+		tries  int64
+	}{
+		{"POST", "", io.ErrUnexpectedEOF, 1},
+		{"POST", "abc", io.ErrUnexpectedEOF, 4},
+		{"GET", "", io.ErrUnexpectedEOF, 4},
+		{"POST", "", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, 4},
+		{"GET", "", errors.New("unknown"), 1},
+	}
+	for i, line := range data {
+		t.Run(fmt.Sprintf("%d-%s", i, line.method), func(t *testing.T) {
+			var count atomic.Int64
+			rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				count.Add(1)
+				return nil, line.err
+			})
+			c := http.Client{Transport: &Retry{
+				Transport: rt,
+				TimeAfter: func(time.Duration) <-chan time.Time {
+					c := make(chan time.Time, 1)
+					c <- time.Now()
+					return c
+				},
+			}}
+			req, err := http.NewRequestWithContext(t.Context(), line.method, "http://localhost", strings.NewReader("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line.key != "" {
+				req.Header.Set("Idempotency-Key", line.key)
+			}
+			if _, err := c.Do(req); !errors.Is(err, line.err) {
+				t.Fatal(err)
+			}
+			if v := count.Load(); v != line.tries {
+				t.Fatalf("expected %d tries, got %d", line.tries, v)
+			}
+		})
+	}
+}
+
+func TestRetry_RetryAfter_MaxDuration(t *testing.T) {
+	var count atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(429)
+	}))
+	defer ts.Close()
+	c := http.Client{Transport: &Retry{
+		Transport: http.DefaultTransport,
+		TimeAfter: func(d time.Duration) <-chan time.Time {
+			t.Errorf("unexpected sleep %s", d)
+			c := make(chan time.Time, 1)
+			c <- time.Now()
+			return c
+		},
+	}}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != 429 {
+		t.Fatal(resp.StatusCode)
+	}
+	if v := count.Load(); v != 1 {
+		t.Fatalf("expected 1 try, got %d", v)
+	}
+}
+
+func TestRetry_RetryAfterPolicy(t *testing.T) {
+	var count atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(429)
+	}))
+	defer ts.Close()
+	// A policy wrapping ExponentialBackoff forwards AllowRetryAfter.
+	p := &wrappedPolicy{ExponentialBackoff: DefaultRetryPolicy, maxRetryAfter: time.Second}
+	c := http.Client{Transport: &Retry{
+		Transport: http.DefaultTransport,
+		Policy:    p,
+		TimeAfter: func(d time.Duration) <-chan time.Time {
+			t.Errorf("unexpected sleep %s", d)
+			c := make(chan time.Time, 1)
+			c <- time.Now()
+			return c
+		},
+	}}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if v := count.Load(); v != 1 || p.calls != 1 {
+		t.Fatalf("expected 1 try, got %d; %d calls", v, p.calls)
+	}
+}
+
 func TestRetry_Unwrap(t *testing.T) {
 	var r http.RoundTripper = &Retry{Transport: http.DefaultTransport}
 	if r.(Unwrapper).Unwrap() != http.DefaultTransport {
@@ -255,6 +773,17 @@ func TestRetry_Unwrap(t *testing.T) {
 
 //
 
+type wrappedPolicy struct {
+	ExponentialBackoff
+	maxRetryAfter time.Duration
+	calls         int
+}
+
+func (w *wrappedPolicy) AllowRetryAfter(start time.Time, try int, d time.Duration) bool {
+	w.calls++
+	return d <= w.maxRetryAfter && w.ExponentialBackoff.AllowRetryAfter(start, try, d)
+}
+
 type reader struct {
 	s string
 }
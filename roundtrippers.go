@@ -27,6 +27,8 @@ func Unwrap(rt http.RoundTripper) http.RoundTripper {
 }
 
 // cloneRequestWithBody clones the request and ensures the http.Request has a GetBody if Body is set.
+//
+// When the body has to be buffered, ContentLength is updated to its actual size.
 func cloneRequestWithBody(req *http.Request) (*http.Request, error) {
 	req2 := req.Clone(req.Context())
 	// See https://github.com/golang/go/issues/73439
@@ -40,6 +42,7 @@ func cloneRequestWithBody(req *http.Request) (*http.Request, error) {
 			return io.NopCloser(bytes.NewBuffer(in)), nil
 		}
 		req2.Body, _ = req2.GetBody()
+		req2.ContentLength = int64(len(in))
 	}
 	return req2, nil
 }